@@ -0,0 +1,280 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"code.jogchat.internal/go-schemaless/models"
+)
+
+// bufferCheckpoint is the name a Replayer saves its checkpoint under
+const bufferCheckpoint = "buffer"
+
+// WithBuffer sets the backend that takes the writes of shards failing with ErrShardUnavailable.
+// Buffered cells are not visible to reads until a Replayer wrote them to their shard.
+func (kv *KVStore) WithBuffer(buffer Storage) *KVStore {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.buffer = buffer
+	return kv
+}
+
+// bufferOnFailure hands a write that failed with err over to the buffer, if one is configured and
+// the shard was unavailable. The write then succeeds, unless buffering fails too. Callers must hold kv.mu.
+func (kv *KVStore) bufferOnFailure(err error, write func(buffer Storage) error) error {
+	if err == nil || kv.buffer == nil || !errors.Is(err, ErrShardUnavailable) {
+		return err
+	}
+	if bufferErr := write(kv.buffer); bufferErr != nil {
+		return fmt.Errorf("%w, and buffering failed: %v", err, bufferErr)
+	}
+	return nil
+}
+
+// ReplayStats reports the progress of a Replayer
+type ReplayStats struct {
+	// Checkpoint is the added_at, in the buffer, of the last cell replayed
+	Checkpoint int64
+	// Scanned counts the cells read from the buffer, Replayed those written to their shard.
+	// The others had been replayed before.
+	Scanned  int64
+	Replayed int64
+	// Remaining is the number of buffered cells after the checkpoint, as of the last batch
+	Remaining int64
+	// Conflicts holds the buffered cells the last Run found another cell in place of on their shard,
+	// with the same ref key. They stay in the buffer, see Run.
+	Conflicts []models.Cell
+}
+
+// Replayer drains the buffer of a KVStore, writing buffered cells to the shard they belong to,
+// in the order they were buffered. The buffer is immutable like any Storage, the Replayer
+// checkpoints how far it got instead of removing what it replayed.
+type Replayer struct {
+	kv           *KVStore
+	checkpoints  Checkpointer
+	batchSize    int
+	ignoreFields map[string][]string
+
+	mu    sync.Mutex
+	stats ReplayStats
+}
+
+// NewReplayer returns a Replayer for the buffer of kv, resuming from the checkpoint it finds
+func NewReplayer(kv *KVStore, checkpoints Checkpointer) *Replayer {
+	return &Replayer{
+		kv:           kv,
+		checkpoints:  checkpoints,
+		batchSize:    defaultCopyBatchSize,
+		ignoreFields: make(map[string][]string),
+	}
+}
+
+// WithBatchSize sets the number of cells read from the buffer at a time
+func (r *Replayer) WithBatchSize(batchSize int) *Replayer {
+	r.batchSize = batchSize
+	return r
+}
+
+// WithIgnoreFields lists the fields of a column that must not be indexed, as passed to PutCell
+func (r *Replayer) WithIgnoreFields(columnKey string, fields ...string) *Replayer {
+	r.ignoreFields[columnKey] = fields
+	return r
+}
+
+// Stats returns the progress of the Replayer
+func (r *Replayer) Stats() ReplayStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.stats
+}
+
+// Run replays the buffer until it is drained. Once a shard turns out unavailable, the cells
+// going to it are skipped for the rest of the run while the other shards keep being replayed, and
+// the checkpoint stays before the first cell skipped. Unavailable shards are reported as
+// ShardErrors, running again rescans from the checkpoint and skips the cells that did make it to
+// their shard. Other failures stop the run, leaving the checkpoint before the batch that failed.
+// A cell whose ref key already holds another cell on its shard, which PutCell would have refused,
+// is not written either: it is reported in ReplayStats.Conflicts and by an error wrapping
+// ErrConflictingCell, and the checkpoint stays before it too. Once it was dealt with,
+// ResetToOffset moves the checkpoint past it.
+func (r *Replayer) Run(ctx context.Context) error {
+	r.kv.mu.RLock()
+	buffer := r.kv.buffer
+	r.kv.mu.RUnlock()
+	if buffer == nil {
+		return errors.New("no buffer configured")
+	}
+
+	// replicas may lag, the replayer must see every buffered cell and what shards already hold
+	ctx = WithReadPolicy(ctx, PrimaryOnly)
+	after, err := r.checkpoints.LoadCheckpoint(ctx, bufferCheckpoint)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.stats.Conflicts = nil
+	r.mu.Unlock()
+
+	var (
+		scan      = after
+		blocked   = make(ShardErrors)
+		held      bool
+		conflicts int
+	)
+	for {
+		cells, found, err := buffer.ScanCells(ctx, scan, r.batchSize)
+		if err != nil {
+			return err
+		}
+		if !found {
+			break
+		}
+
+		replayed, skipped, conflicting, err := r.replayBatch(ctx, cells, blocked)
+		if err != nil {
+			return err
+		}
+		conflicts += len(conflicting)
+		scan = cells[len(cells)-1].AddedAt
+		// the checkpoint must not move past a skipped cell
+		if !held {
+			if skipped > 0 {
+				after = cells[skipped-1].AddedAt
+				if err := r.checkpoints.SaveCheckpoint(ctx, bufferCheckpoint, after); err != nil {
+					return err
+				}
+			}
+			held = skipped < len(cells)
+		}
+		remaining, err := buffer.CountCellsAfter(ctx, after)
+		if err != nil {
+			return err
+		}
+
+		r.mu.Lock()
+		r.stats.Checkpoint = after
+		r.stats.Scanned += int64(len(cells))
+		r.stats.Replayed += replayed
+		r.stats.Remaining = remaining
+		r.stats.Conflicts = append(r.stats.Conflicts, conflicting...)
+		r.mu.Unlock()
+	}
+
+	if conflicts > 0 {
+		return fmt.Errorf("%d buffered cells: %w", conflicts, ErrConflictingCell)
+	}
+	if len(blocked) > 0 {
+		return blocked
+	}
+	return nil
+}
+
+// ResetToOffset moves the checkpoint of the buffer to addedAt, so that the next Run replays the
+// buffered cells that follow it, say to move past conflicts that were dealt with
+func (r *Replayer) ResetToOffset(ctx context.Context, addedAt int64) error {
+	return r.checkpoints.SaveCheckpoint(ctx, bufferCheckpoint, addedAt)
+}
+
+// Loop runs the Replayer every interval until ctx is done, waiting for the next round while shards
+// are still unavailable. Other failures are returned, conflicts included.
+func (r *Replayer) Loop(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.Run(ctx); err != nil && !errors.Is(err, ErrShardUnavailable) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// replayBatch writes cells to the shards writes currently go to, returning how many were written,
+// the index of the first cell left out, len(cells) if none was, and the cells that conflict with
+// their shard, which are left out too. The cells of blocked shards are left out, and a shard
+// turning out unavailable is added to blocked.
+func (r *Replayer) replayBatch(ctx context.Context, cells []models.Cell, blocked ShardErrors) (int64, int, []models.Cell, error) {
+	type group struct {
+		shard     string
+		columnKey string
+	}
+
+	r.kv.mu.RLock()
+	chooser, storages := r.kv.continuum, r.kv.storages
+	if r.kv.migration != nil {
+		chooser, storages = r.kv.migration, r.kv.mstorages
+	}
+	groups := make(map[group][]models.Cell)
+	targets := make(map[string]Storage)
+	// first holds the index of the first cell going to each shard
+	first := make(map[string]int)
+	var keys []group
+	for i, cell := range cells {
+		key := group{shard: chooser.Choose(string(cell.RowKey)), columnKey: cell.ColumnName}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		if _, ok := first[key.shard]; !ok {
+			first[key.shard] = i
+		}
+		groups[key] = append(groups[key], cell)
+		targets[key.shard] = storages[key.shard]
+	}
+	r.kv.mu.RUnlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].shard != keys[j].shard {
+			return keys[i].shard < keys[j].shard
+		}
+		return keys[i].columnKey < keys[j].columnKey
+	})
+
+	var (
+		replayed  int64
+		conflicts []models.Cell
+	)
+	for _, key := range keys {
+		if _, ok := blocked[key.shard]; ok {
+			continue
+		}
+		n, conflicting, err := writeCells(ctx, targets[key.shard], key.columnKey, groups[key], r.ignoreFields[key.columnKey])
+		replayed += n
+		conflicts = append(conflicts, conflicting...)
+		if errors.Is(err, ErrShardUnavailable) {
+			blocked[key.shard] = err
+			continue
+		}
+		if err != nil {
+			return replayed, 0, nil, fmt.Errorf("shard %s: %w", key.shard, err)
+		}
+	}
+
+	skipped := len(cells)
+	for shard := range blocked {
+		if i, ok := first[shard]; ok && i < skipped {
+			skipped = i
+		}
+	}
+	// the cells keep their added_at in the buffer, which orders them
+	for _, conflict := range conflicts {
+		for i := 0; i < skipped; i++ {
+			if cells[i].AddedAt == conflict.AddedAt {
+				skipped = i
+				break
+			}
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].AddedAt < conflicts[j].AddedAt })
+	return replayed, skipped, conflicts, nil
+}
@@ -0,0 +1,194 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"code.jogchat.internal/go-schemaless/core"
+	"code.jogchat.internal/go-schemaless/models"
+	"code.jogchat.internal/go-schemaless/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyStorage fails writes and the reads replaying them need while down is set
+type flakyStorage struct {
+	*memory.Storage
+	down *int32
+}
+
+func (s flakyStorage) failing() bool {
+	return atomic.LoadInt32(s.down) == 1
+}
+
+func (s flakyStorage) PutCell(ctx context.Context, rowKey []byte, columnKey string, refKey int64, cell models.Cell, ignoreFields ...string) error {
+	if s.failing() {
+		return core.ErrShardUnavailable
+	}
+	return s.Storage.PutCell(ctx, rowKey, columnKey, refKey, cell, ignoreFields...)
+}
+
+func (s flakyStorage) PutCells(ctx context.Context, cells []models.Cell, ignoreFields ...string) error {
+	if s.failing() {
+		return core.ErrShardUnavailable
+	}
+	return s.Storage.PutCells(ctx, cells, ignoreFields...)
+}
+
+func (s flakyStorage) MultiGetCellLatest(ctx context.Context, rowKeys [][]byte, columnKey string) (map[string]models.Cell, bool, error) {
+	if s.failing() {
+		return nil, false, core.ErrShardUnavailable
+	}
+	return s.Storage.MultiGetCellLatest(ctx, rowKeys, columnKey)
+}
+
+func TestBufferedWrites(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	shard := flakyStorage{Storage: memory.New(), down: new(int32)}
+	kv := core.New([]core.Shard{{Name: "shard0", Backend: shard}})
+	atomic.StoreInt32(shard.down, 1)
+
+	cell := newBusiness(1, "companies", "uber.com", "Uber")
+	assert.True(errors.Is(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell), core.ErrShardUnavailable))
+	assert.Error(core.NewReplayer(kv, core.NewMemoryCheckpointer()).Run(ctx), "no buffer")
+
+	buffer := memory.New()
+	kv.WithBuffer(buffer)
+	assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+	second := newBusiness(2, "companies", "ubereats.com", "Uber Eats")
+	second.RowKey = cell.RowKey
+	_, err := kv.PutCells(ctx, []models.Cell{second})
+	assert.NoError(err)
+	_, found, err := kv.GetCellLatest(ctx, cell.RowKey, "companies")
+	assert.NoError(err)
+	assert.False(found, "buffered cells are not visible yet")
+
+	checkpoints := core.NewMemoryCheckpointer()
+	replayer := core.NewReplayer(kv, checkpoints).WithBatchSize(1)
+	assert.True(errors.Is(replayer.Run(ctx), core.ErrShardUnavailable))
+	assert.Equal(core.ReplayStats{Scanned: 2, Remaining: 2}, replayer.Stats())
+
+	// once back, the shard takes a newer version before the buffer is replayed
+	atomic.StoreInt32(shard.down, 0)
+	third := newBusiness(3, "companies", "uberfreight.com", "Uber Freight")
+	third.RowKey = cell.RowKey
+	assert.NoError(kv.PutCell(ctx, third.RowKey, third.ColumnName, third.RefKey, third))
+
+	assert.NoError(replayer.Run(ctx))
+	assert.Equal(core.ReplayStats{Checkpoint: replayer.Stats().Checkpoint, Scanned: 4, Replayed: 2}, replayer.Stats())
+
+	versions, _, err := kv.GetCellVersions(ctx, cell.RowKey, "companies", core.VersionOptions{})
+	assert.NoError(err)
+	assert.Len(versions, 3)
+	// the index keeps following the latest version
+	latest, found, err := kv.GetCellByUniqueFieldLatest(ctx, "companies", "domain", "uberfreight.com")
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(int64(3), latest.RefKey)
+	found, err = kv.CheckValueExist(ctx, "companies", "domain", "uber.com")
+	assert.NoError(err)
+	assert.False(found)
+
+	// replaying from scratch writes nothing twice
+	again := core.NewReplayer(kv, core.NewMemoryCheckpointer())
+	assert.NoError(again.Run(ctx))
+	assert.Equal(int64(2), again.Stats().Scanned)
+	assert.Zero(again.Stats().Replayed)
+}
+
+func TestReplayAroundDownShard(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	up := flakyStorage{Storage: memory.New(), down: new(int32)}
+	down := flakyStorage{Storage: memory.New(), down: new(int32)}
+	kv := core.New([]core.Shard{{Name: "up", Backend: up}, {Name: "down", Backend: down}}).WithBuffer(memory.New())
+	atomic.StoreInt32(up.down, 1)
+	atomic.StoreInt32(down.down, 1)
+
+	var cells []models.Cell
+	for i := 0; i < 20; i++ {
+		cell := newBusiness(1, "companies", "uber.com", "Uber")
+		assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+		cells = append(cells, cell)
+	}
+
+	// one shard staying down holds back neither the replay of the other nor its own
+	atomic.StoreInt32(up.down, 0)
+	checkpoints := core.NewMemoryCheckpointer()
+	replayer := core.NewReplayer(kv, checkpoints).WithBatchSize(3)
+	var shardErrs core.ShardErrors
+	assert.True(errors.As(replayer.Run(ctx), &shardErrs))
+	assert.Len(shardErrs, 1)
+	assert.True(errors.Is(shardErrs["down"], core.ErrShardUnavailable))
+	assert.True(replayer.Stats().Remaining > 0)
+	for _, cell := range cells {
+		_, found, err := kv.GetCellLatest(ctx, cell.RowKey, "companies")
+		if kv.ShardFor(cell.RowKey) == "up" {
+			assert.NoError(err)
+			assert.True(found)
+		} else {
+			assert.True(errors.Is(err, core.ErrShardUnavailable) || !found)
+		}
+	}
+
+	atomic.StoreInt32(down.down, 0)
+	replayer = core.NewReplayer(kv, checkpoints)
+	assert.NoError(replayer.Run(ctx))
+	assert.Zero(replayer.Stats().Remaining)
+	for _, cell := range cells {
+		latest, found, err := kv.GetCellLatest(ctx, cell.RowKey, "companies")
+		assert.NoError(err)
+		assert.True(found)
+		assert.Equal(cell.Body, latest.Body)
+	}
+}
+
+func TestReplayConflicts(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	shard := flakyStorage{Storage: memory.New(), down: new(int32)}
+	buffer := memory.New()
+	kv := core.New([]core.Shard{{Name: "shard0", Backend: shard}}).WithBuffer(buffer)
+	atomic.StoreInt32(shard.down, 1)
+
+	buffered := newBusiness(1, "companies", "uber.com", "Uber")
+	assert.NoError(kv.PutCell(ctx, buffered.RowKey, buffered.ColumnName, buffered.RefKey, buffered))
+	other := newBusiness(1, "companies", "lyft.com", "Lyft")
+	assert.NoError(kv.PutCell(ctx, other.RowKey, other.ColumnName, other.RefKey, other))
+
+	// another writer took the ref key of the first buffered cell meanwhile
+	atomic.StoreInt32(shard.down, 0)
+	taken := newBusiness(1, "companies", "ubereats.com", "Uber Eats")
+	taken.RowKey = buffered.RowKey
+	assert.NoError(kv.PutCell(ctx, taken.RowKey, taken.ColumnName, taken.RefKey, taken))
+
+	checkpoints := core.NewMemoryCheckpointer()
+	replayer := core.NewReplayer(kv, checkpoints)
+	assert.True(errors.Is(replayer.Run(ctx), core.ErrConflictingCell))
+	stats := replayer.Stats()
+	if assert.Len(stats.Conflicts, 1) {
+		assert.Equal(buffered.Body, stats.Conflicts[0].Body)
+	}
+	assert.Zero(stats.Checkpoint, "the conflicting cell stays in the buffer")
+	assert.Equal(int64(2), stats.Remaining)
+	latest, found, err := kv.GetCellLatest(ctx, taken.RowKey, "companies")
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(taken.Body, latest.Body)
+	_, found, err = kv.GetCellLatest(ctx, other.RowKey, "companies")
+	assert.NoError(err)
+	assert.True(found, "the other cells are replayed all the same")
+
+	// it is reported again until the checkpoint is moved past it
+	assert.True(errors.Is(replayer.Run(ctx), core.ErrConflictingCell))
+	assert.Len(replayer.Stats().Conflicts, 1)
+	assert.NoError(replayer.ResetToOffset(ctx, stats.Conflicts[0].AddedAt))
+	assert.NoError(replayer.Run(ctx))
+	assert.Empty(replayer.Stats().Conflicts)
+	assert.Zero(replayer.Stats().Remaining)
+}
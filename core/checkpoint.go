@@ -0,0 +1,186 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"code.jogchat.internal/go-schemaless/models"
+)
+
+// Checkpointer persists how far a background job got through each shard, as the added_at
+// of the last cell it processed, so that it can resume there after a restart
+type Checkpointer interface {
+	// LoadCheckpoint returns the saved added_at of shard, 0 if there is none
+	LoadCheckpoint(ctx context.Context, shard string) (addedAt int64, err error)
+	// SaveCheckpoint records that every cell of shard up to addedAt was processed
+	SaveCheckpoint(ctx context.Context, shard string, addedAt int64) error
+}
+
+// defaultGapGrace is how long Triggers and the Copier wait for a hole in the added_at of a shard to fill
+const defaultGapGrace = 10 * time.Second
+
+// settled returns how many of cells, scanned after after in added_at order, can be processed and
+// checkpointed. MySQL and Postgres hand out added_at when a cell is inserted, not when it commits,
+// so a hole in the sequence may be a transaction still running, whose cell would be skipped once
+// checkpointed past. Cells following a hole are held back while younger than grace, older holes
+// were left by transactions that rolled back.
+func settled(after int64, cells []models.Cell, grace time.Duration) int {
+	for i, cell := range cells {
+		if cell.AddedAt > after+1 && cell.CreatedAt != nil && time.Since(*cell.CreatedAt) < grace {
+			return i
+		}
+		after = cell.AddedAt
+	}
+	return len(cells)
+}
+
+// MemoryCheckpointer keeps checkpoints in memory, for tests and jobs that may start over
+type MemoryCheckpointer struct {
+	mu          sync.Mutex
+	checkpoints map[string]int64
+}
+
+// NewMemoryCheckpointer returns an empty MemoryCheckpointer
+func NewMemoryCheckpointer() *MemoryCheckpointer {
+	return &MemoryCheckpointer{checkpoints: make(map[string]int64)}
+}
+
+func (m *MemoryCheckpointer) LoadCheckpoint(ctx context.Context, shard string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.checkpoints[shard], nil
+}
+
+func (m *MemoryCheckpointer) SaveCheckpoint(ctx context.Context, shard string, addedAt int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.checkpoints[shard] = addedAt
+	return nil
+}
+
+// FileCheckpointer keeps the checkpoints of every shard in a JSON file, replaced atomically on each save
+type FileCheckpointer struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileCheckpointer returns a FileCheckpointer backed by path, which need not exist yet
+func NewFileCheckpointer(path string) *FileCheckpointer {
+	return &FileCheckpointer{path: path}
+}
+
+func (f *FileCheckpointer) LoadCheckpoint(ctx context.Context, shard string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	checkpoints, err := f.read()
+	if err != nil {
+		return 0, err
+	}
+	return checkpoints[shard], nil
+}
+
+func (f *FileCheckpointer) SaveCheckpoint(ctx context.Context, shard string, addedAt int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	checkpoints, err := f.read()
+	if err != nil {
+		return err
+	}
+	checkpoints[shard] = addedAt
+
+	bytes, err := json.Marshal(checkpoints)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path, bytes)
+}
+
+// read loads every checkpoint from the file, callers must hold f.mu
+func (f *FileCheckpointer) read() (map[string]int64, error) {
+	checkpoints := make(map[string]int64)
+	bytes, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return checkpoints, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bytes, &checkpoints); err != nil {
+		return nil, err
+	}
+	return checkpoints, nil
+}
+
+// ShardCheckpointer keeps the checkpoint of each shard in the checkpoint table of that shard, under the
+// name of a consumer, so that several consumers can tail the same shards and each resume where it stopped.
+// Checkpoints must be saved under shard names, as Triggers do, those of a Copier are kept per migration.
+type ShardCheckpointer struct {
+	kv       *KVStore
+	consumer string
+}
+
+// NewShardCheckpointer returns a ShardCheckpointer saving the checkpoints of consumer on the shards of kv
+func NewShardCheckpointer(kv *KVStore, consumer string) *ShardCheckpointer {
+	return &ShardCheckpointer{kv: kv, consumer: consumer}
+}
+
+func (c *ShardCheckpointer) LoadCheckpoint(ctx context.Context, shard string) (int64, error) {
+	storage, err := c.storage(shard)
+	if err != nil {
+		return 0, err
+	}
+	return storage.LoadCheckpoint(ctx, c.consumer)
+}
+
+func (c *ShardCheckpointer) SaveCheckpoint(ctx context.Context, shard string, addedAt int64) error {
+	storage, err := c.storage(shard)
+	if err != nil {
+		return err
+	}
+	return storage.SaveCheckpoint(ctx, c.consumer, addedAt)
+}
+
+// storage returns the storage of shard, in either layout during a migration
+func (c *ShardCheckpointer) storage(shard string) (Storage, error) {
+	c.kv.mu.RLock()
+	defer c.kv.mu.RUnlock()
+
+	if storage, ok := c.kv.storages[shard]; ok {
+		return storage, nil
+	}
+	if storage, ok := c.kv.mstorages[shard]; ok {
+		return storage, nil
+	}
+	return nil, fmt.Errorf("unknown shard %s", shard)
+}
+
+// writeFileAtomic writes bytes aside and renames them over path, so that a crash never leaves a truncated file behind
+func writeFileAtomic(path string, bytes []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bytes); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
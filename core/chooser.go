@@ -0,0 +1,347 @@
+package core
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+
+	jh "code.jogchat.internal/dgryski-go-shardedkv/choosers/jump"
+)
+
+// ChooserConfig selects how row keys are mapped onto shards
+type ChooserConfig struct {
+	// Kind is "jump" (the default), "ketama", "rendezvous" or "keyrange"
+	Kind string `json:"kind"`
+	// Hash is the hash function applied to row keys, "metro" (the default), "fnv1a", "crc32" or "md5".
+	// Key ranges compare row keys as they are and take no hash.
+	Hash string `json:"hash"`
+	// Weights gives each shard a share of the rows proportional to its weight, 1 for shards left out
+	Weights map[string]int `json:"weights"`
+	// RangeStarts holds the lowest row key of each shard of a key range layout, hex encoded, the
+	// lowest one being empty. Without them the key space is split by weight, in shard order.
+	RangeStarts map[string]string `json:"range_starts"`
+}
+
+// hashes are the hash functions a ChooserConfig can name
+var hashes = map[string]func([]byte) uint64{
+	"metro": hash64,
+	"fnv1a": func(b []byte) uint64 {
+		h := fnv.New64a()
+		h.Write(b)
+		return h.Sum64()
+	},
+	"crc32": func(b []byte) uint64 { return uint64(crc32.ChecksumIEEE(b)) },
+	// the first four bytes of the digest, little endian, as libketama reads them
+	"md5": func(b []byte) uint64 {
+		sum := md5.Sum(b)
+		return uint64(binary.LittleEndian.Uint32(sum[:4]))
+	},
+}
+
+// NewChooser returns the Chooser described by config, with no buckets set yet
+func NewChooser(config ChooserConfig) (Chooser, error) {
+	for shard, weight := range config.Weights {
+		if weight <= 0 {
+			return nil, fmt.Errorf("shard %s: weight must be positive, got %d", shard, weight)
+		}
+	}
+
+	if config.Kind == "keyrange" {
+		if config.Hash != "" {
+			return nil, fmt.Errorf("key ranges do not hash row keys, got hash %s", config.Hash)
+		}
+		starts := make(map[string][]byte, len(config.RangeStarts))
+		for shard, start := range config.RangeStarts {
+			key, err := hex.DecodeString(start)
+			if err != nil {
+				return nil, fmt.Errorf("shard %s: range start: %v", shard, err)
+			}
+			starts[shard] = key
+		}
+		return &keyRangeChooser{weights: config.Weights, starts: starts}, nil
+	}
+	if len(config.RangeStarts) > 0 {
+		return nil, fmt.Errorf("range starts only apply to key ranges, not %s", config.Kind)
+	}
+
+	name := config.Hash
+	if name == "" {
+		name = "metro"
+	}
+	hash, ok := hashes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash %s", name)
+	}
+
+	switch config.Kind {
+	case "", "jump":
+		return &jumpChooser{jump: jh.New(hash), hashName: name, weights: config.Weights}, nil
+	case "ketama":
+		return &ketamaChooser{hash: hash, hashName: name, weights: config.Weights}, nil
+	case "rendezvous":
+		return &rendezvousChooser{hash: hash, hashName: name, weights: config.Weights}, nil
+	default:
+		return nil, fmt.Errorf("unknown chooser %s", config.Kind)
+	}
+}
+
+// weightOf returns the weight of shard, 1 unless weights says otherwise
+func weightOf(weights map[string]int, shard string) int {
+	if weight, ok := weights[shard]; ok {
+		return weight
+	}
+	return 1
+}
+
+// errNoBuckets is returned by SetBuckets for an empty list, a chooser must always have a shard to pick
+var errNoBuckets = errors.New("a chooser needs at least one bucket")
+
+// jumpChooser is jump hash over buckets repeated by weight. Without weights it routes
+// exactly as the plain jump hash of New does.
+type jumpChooser struct {
+	jump     *jh.Jump
+	hashName string
+	weights  map[string]int
+	buckets  []string
+}
+
+func (c *jumpChooser) SetBuckets(buckets []string) error {
+	if len(buckets) == 0 {
+		return errNoBuckets
+	}
+	var slots []string
+	for _, bucket := range buckets {
+		for i := 0; i < weightOf(c.weights, bucket); i++ {
+			slots = append(slots, bucket)
+		}
+	}
+	if err := c.jump.SetBuckets(slots); err != nil {
+		return err
+	}
+	c.buckets = append([]string(nil), buckets...)
+	return nil
+}
+
+func (c *jumpChooser) Choose(key string) string {
+	return c.jump.Choose(key)
+}
+
+func (c *jumpChooser) Buckets() []string {
+	return c.buckets
+}
+
+// ketamaPointsPerWeight is the number of points a bucket of weight 1 gets on the ketama continuum
+const ketamaPointsPerWeight = 160
+
+type ketamaPoint struct {
+	hash   uint64
+	bucket string
+}
+
+// ketamaChooser is consistent hashing: buckets own the arcs of a continuum leading to their points,
+// so that adding or removing a bucket only moves the rows of the arcs it gains or loses
+type ketamaChooser struct {
+	hash     func([]byte) uint64
+	hashName string
+	weights  map[string]int
+	buckets  []string
+	points   []ketamaPoint
+}
+
+func (c *ketamaChooser) SetBuckets(buckets []string) error {
+	if len(buckets) == 0 {
+		return errNoBuckets
+	}
+	var points []ketamaPoint
+	for _, bucket := range buckets {
+		for i := 0; i < ketamaPointsPerWeight*weightOf(c.weights, bucket); i++ {
+			// the index goes first, as hashes like fnv1a barely mix the last bytes of their input
+			points = append(points, ketamaPoint{hash: c.hash([]byte(strconv.Itoa(i) + "-" + bucket)), bucket: bucket})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].bucket < points[j].bucket
+	})
+	c.buckets = append([]string(nil), buckets...)
+	c.points = points
+	return nil
+}
+
+func (c *ketamaChooser) Choose(key string) string {
+	hash := c.hash([]byte(key))
+	i := sort.Search(len(c.points), func(i int) bool { return c.points[i].hash >= hash })
+	if i == len(c.points) {
+		i = 0
+	}
+	return c.points[i].bucket
+}
+
+func (c *ketamaChooser) Buckets() []string {
+	return c.buckets
+}
+
+// rendezvousChooser is highest random weight hashing: each row goes to the bucket scoring highest
+// for it, so that removing a bucket only moves its own rows
+type rendezvousChooser struct {
+	hash     func([]byte) uint64
+	hashName string
+	weights  map[string]int
+	buckets  []string
+}
+
+func (c *rendezvousChooser) SetBuckets(buckets []string) error {
+	if len(buckets) == 0 {
+		return errNoBuckets
+	}
+	c.buckets = append([]string(nil), buckets...)
+	return nil
+}
+
+func (c *rendezvousChooser) Choose(key string) string {
+	var (
+		best      string
+		bestScore = math.Inf(-1)
+	)
+	for _, bucket := range c.buckets {
+		// -weight / ln(u) for u uniform in (0, 1) gives each bucket a share proportional to its weight
+		u := (float64(mix64(c.hash([]byte(bucket+key)))>>11) + 0.5) / (1 << 53)
+		score := -float64(weightOf(c.weights, bucket)) / math.Log(u)
+		if score > bestScore || score == bestScore && bucket < best {
+			best, bestScore = bucket, score
+		}
+	}
+	return best
+}
+
+func (c *rendezvousChooser) Buckets() []string {
+	return c.buckets
+}
+
+// mix64 is the finalizer of MurmurHash3, spreading 32 bit hashes like crc32 over 64 bits
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// keyRangeChooser gives each bucket a contiguous range of row keys
+type keyRangeChooser struct {
+	weights map[string]int
+	starts  map[string][]byte
+	buckets []string
+	// ranges is ordered by start
+	ranges []keyRange
+}
+
+type keyRange struct {
+	start  []byte
+	bucket string
+}
+
+func (c *keyRangeChooser) SetBuckets(buckets []string) error {
+	if len(buckets) == 0 {
+		return errNoBuckets
+	}
+	var ranges []keyRange
+	if len(c.starts) > 0 {
+		for _, bucket := range buckets {
+			start, ok := c.starts[bucket]
+			if !ok {
+				return fmt.Errorf("shard %s has no range start", bucket)
+			}
+			ranges = append(ranges, keyRange{start: start, bucket: bucket})
+		}
+		sort.Slice(ranges, func(i, j int) bool { return bytes.Compare(ranges[i].start, ranges[j].start) < 0 })
+		if len(ranges) > 0 && len(ranges[0].start) > 0 {
+			return fmt.Errorf("the lowest range, of shard %s, must start from the empty key", ranges[0].bucket)
+		}
+		for i := 1; i < len(ranges); i++ {
+			if bytes.Equal(ranges[i-1].start, ranges[i].start) {
+				return fmt.Errorf("shards %s and %s start at the same key", ranges[i-1].bucket, ranges[i].bucket)
+			}
+		}
+	} else {
+		// split the space of the first 8 bytes of the row keys by weight
+		var total float64
+		for _, bucket := range buckets {
+			total += float64(weightOf(c.weights, bucket))
+		}
+		var covered float64
+		for _, bucket := range buckets {
+			start := make([]byte, 8)
+			binary.BigEndian.PutUint64(start, uint64(covered/total*math.MaxUint64))
+			if covered == 0 {
+				start = nil
+			}
+			ranges = append(ranges, keyRange{start: start, bucket: bucket})
+			covered += float64(weightOf(c.weights, bucket))
+		}
+	}
+
+	c.buckets = append([]string(nil), buckets...)
+	c.ranges = ranges
+	return nil
+}
+
+func (c *keyRangeChooser) Choose(key string) string {
+	i := sort.Search(len(c.ranges), func(i int) bool { return bytes.Compare(c.ranges[i].start, []byte(key)) > 0 })
+	return c.ranges[i-1].bucket
+}
+
+func (c *keyRangeChooser) Buckets() []string {
+	return c.buckets
+}
+
+// removable reports whether chooser can stop routing to bucket without moving the rows of the
+// other buckets: jump hash only loses its last bucket that way, ketama and rendezvous any, and key
+// ranges any but the lowest when their starts are fixed. Other choosers are never assumed to.
+func removable(chooser Chooser, bucket string) bool {
+	switch c := chooser.(type) {
+	case *jh.Jump:
+		buckets := c.Buckets()
+		return buckets[len(buckets)-1] == bucket
+	case *jumpChooser:
+		return c.buckets[len(c.buckets)-1] == bucket
+	case *ketamaChooser, *rendezvousChooser:
+		return true
+	case *keyRangeChooser:
+		return len(c.starts[bucket]) > 0
+	default:
+		return false
+	}
+}
+
+// describe returns what decides where chooser routes rows, equal for choosers routing alike.
+// Choosers from outside this package are described by their type and buckets alone.
+func describe(chooser Chooser) string {
+	switch c := chooser.(type) {
+	case *jh.Jump:
+		return fmt.Sprintf("jump metro %v", c.Buckets())
+	case *jumpChooser:
+		return fmt.Sprintf("jump %s %v %v", c.hashName, c.weights, c.buckets)
+	case *ketamaChooser:
+		return fmt.Sprintf("ketama %s %v %v", c.hashName, c.weights, c.buckets)
+	case *rendezvousChooser:
+		return fmt.Sprintf("rendezvous %s %v %v", c.hashName, c.weights, c.buckets)
+	case *keyRangeChooser:
+		return fmt.Sprintf("keyrange %v %v %v", c.weights, c.starts, c.buckets)
+	case *shardMapChooser:
+		return fmt.Sprintf("shardmap %v", c.m.Shards)
+	default:
+		return fmt.Sprintf("%T %v", chooser, chooser.Buckets())
+	}
+}
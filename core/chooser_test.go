@@ -0,0 +1,141 @@
+package core_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"code.jogchat.internal/go-schemaless/core"
+	"code.jogchat.internal/go-schemaless/storage/memory"
+	"code.jogchat.internal/go-schemaless/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func newChooser(t *testing.T, config core.ChooserConfig, buckets ...string) core.Chooser {
+	chooser, err := core.NewChooser(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) == 0 {
+		return chooser
+	}
+	if err := chooser.SetBuckets(buckets); err != nil {
+		t.Fatal(err)
+	}
+	return chooser
+}
+
+func TestNewChooser(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, config := range []core.ChooserConfig{
+		{Kind: "modulo"},
+		{Hash: "sha1"},
+		{Kind: "keyrange", Hash: "metro"},
+		{Kind: "ketama", RangeStarts: map[string]string{"shard0": ""}},
+		{Kind: "keyrange", RangeStarts: map[string]string{"shard0": "zz"}},
+		{Weights: map[string]int{"shard0": 0}},
+		{Kind: "ketama", Weights: map[string]int{"shard0": -1}},
+	} {
+		_, err := core.NewChooser(config)
+		assert.Error(err, "%+v", config)
+	}
+
+	// a chooser without buckets would have nothing to choose
+	for _, kind := range []string{"jump", "ketama", "rendezvous", "keyrange"} {
+		chooser, err := core.NewChooser(core.ChooserConfig{Kind: kind})
+		assert.NoError(err)
+		assert.Error(chooser.SetBuckets(nil), kind)
+	}
+	_, err := core.NewWithChooser(nil, newChooser(t, core.ChooserConfig{Kind: "ketama"}, "shard0"))
+	assert.Error(err)
+
+	keyRange, err := core.NewChooser(core.ChooserConfig{Kind: "keyrange", RangeStarts: map[string]string{"shard0": "00", "shard1": "80"}})
+	assert.NoError(err)
+	assert.Error(keyRange.SetBuckets([]string{"shard0", "shard1", "shard2"}), "shard2 has no range start")
+	keyRange, err = core.NewChooser(core.ChooserConfig{Kind: "keyrange", RangeStarts: map[string]string{"shard0": "", "shard1": "80"}})
+	assert.NoError(err)
+	assert.NoError(keyRange.SetBuckets([]string{"shard1", "shard0"}))
+	assert.Equal("shard0", keyRange.Choose("\x7f\xff"))
+	assert.Equal("shard1", keyRange.Choose("\x80"))
+	assert.Equal("shard1", keyRange.Choose("\xff\xff"))
+}
+
+func TestChooserWeights(t *testing.T) {
+	for _, kind := range []string{"jump", "ketama", "rendezvous", "keyrange"} {
+		for _, hash := range []string{"metro", "fnv1a", "crc32", "md5"} {
+			config := core.ChooserConfig{Kind: kind, Hash: hash, Weights: map[string]int{"big": 3}}
+			if kind == "keyrange" {
+				if hash != "metro" {
+					continue
+				}
+				config.Hash = ""
+			}
+			t.Run(fmt.Sprintf("%s/%s", kind, hash), func(t *testing.T) {
+				chooser := newChooser(t, config, "small", "big")
+				assert.Equal(t, []string{"small", "big"}, chooser.Buckets())
+
+				counts := make(map[string]int)
+				for i := 0; i < 8000; i++ {
+					counts[chooser.Choose(string(utils.NewUUID().Bytes()))]++
+				}
+				// big should get about three quarters of the rows
+				assert.InDelta(t, 6000, counts["big"], 800, "%v", counts)
+			})
+		}
+	}
+}
+
+func TestChooserAddBucket(t *testing.T) {
+	for _, kind := range []string{"jump", "ketama", "rendezvous"} {
+		t.Run(kind, func(t *testing.T) {
+			before := newChooser(t, core.ChooserConfig{Kind: kind}, "shard0", "shard1")
+			after := newChooser(t, core.ChooserConfig{Kind: kind}, "shard0", "shard1", "shard2")
+
+			// rows either stay or move to the new bucket
+			for i := 0; i < 1000; i++ {
+				key := string(utils.NewUUID().Bytes())
+				if shard := after.Choose(key); shard != "shard2" {
+					assert.Equal(t, before.Choose(key), shard)
+				}
+			}
+		})
+	}
+}
+
+func TestNewWithChooser(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	shards := []core.Shard{{Name: "shard0", Backend: memory.New()}, {Name: "shard1", Backend: memory.New()}}
+	_, err := core.NewWithChooser(append(shards, shards[0]), newChooser(t, core.ChooserConfig{}))
+	assert.Error(err, "shard0 listed twice")
+
+	// the default chooser routes as New does
+	kv, err := core.NewWithChooser(shards, newChooser(t, core.ChooserConfig{}))
+	assert.NoError(err)
+	plain := core.New(shards)
+	for i := 0; i < 100; i++ {
+		rowKey := utils.NewUUID().Bytes()
+		assert.Equal(plain.ShardFor(rowKey), kv.ShardFor(rowKey))
+	}
+
+	chooser, err := core.NewChooser(core.ChooserConfig{Kind: "rendezvous", Weights: map[string]int{"shard2": 2}})
+	assert.NoError(err)
+	kv, err = core.NewWithChooser(shards, chooser)
+	assert.NoError(err)
+	cell := newBusiness(1, "companies", "uber.com", "Uber")
+	assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+
+	// moving onto another scheme goes through a migration
+	next := append(shards, core.Shard{Name: "shard2", Backend: memory.New()})
+	chooser, err = core.NewChooser(core.ChooserConfig{Kind: "ketama", Hash: "md5"})
+	assert.NoError(err)
+	assert.NoError(kv.BeginMigrationWithChooser(next, chooser))
+	assert.NoError(core.NewCopier(kv, core.NewMemoryCheckpointer()).Run(ctx))
+	assert.NoError(kv.CompleteMigration())
+	latest, found, err := kv.GetCellLatest(ctx, cell.RowKey, "companies")
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(cell.Body, latest.Body)
+}
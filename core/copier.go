@@ -0,0 +1,384 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"code.jogchat.internal/go-schemaless/models"
+)
+
+// defaultCopyBatchSize is the number of cells a Copier scans from a shard at a time
+const defaultCopyBatchSize = 500
+
+// CopyStats reports the progress of a Copier on one shard of the current layout
+type CopyStats struct {
+	Shard string
+	// Checkpoint is the added_at of the last cell processed
+	Checkpoint int64
+	// Scanned counts the cells read from the shard, Copied those written to their new shard.
+	// The others already lived on the right shard, or had been copied before.
+	Scanned int64
+	Copied  int64
+	// Remaining is the number of cells after the checkpoint, as of the last batch. It includes
+	// those written since Run started, which are left to the next Run.
+	Remaining int64
+	// Throughput is the number of cells scanned per second since Run started
+	Throughput float64
+	// Done is set once every cell the shard held when Run started was scanned
+	Done bool
+}
+
+// Copier moves the cells of a shard migration's current layout onto the new layout.
+// It scans each shard of the current layout by added_at, rewrites the cells whose shard
+// changes along with their index entries, and checkpoints its progress after every batch.
+// Checkpoints are kept per migration, see MigrationStatus.ID, so a Checkpointer may be reused
+// by later migrations, and a migration begun again between the same layouts, say after a restart,
+// resumes where the last Run stopped.
+type Copier struct {
+	kv           *KVStore
+	checkpoints  Checkpointer
+	batchSize    int
+	gapGrace     time.Duration
+	ignoreFields map[string][]string
+
+	mu    sync.Mutex
+	stats map[string]*CopyStats
+}
+
+// NewCopier returns a Copier for the migration of kv, resuming from the checkpoints it finds
+func NewCopier(kv *KVStore, checkpoints Checkpointer) *Copier {
+	return &Copier{
+		kv:           kv,
+		checkpoints:  checkpoints,
+		batchSize:    defaultCopyBatchSize,
+		gapGrace:     defaultGapGrace,
+		ignoreFields: make(map[string][]string),
+		stats:        make(map[string]*CopyStats),
+	}
+}
+
+// WithBatchSize sets the number of cells scanned from a shard at a time
+func (c *Copier) WithBatchSize(batchSize int) *Copier {
+	c.batchSize = batchSize
+	return c
+}
+
+// WithGapGrace sets how long a hole in the added_at of a shard holds the cells following it back,
+// 10 seconds by default. The shard is then left for the next Run, which copies the cell filling it.
+func (c *Copier) WithGapGrace(grace time.Duration) *Copier {
+	c.gapGrace = grace
+	return c
+}
+
+// WithIgnoreFields lists the fields of a column that must not be indexed, as passed to PutCell
+func (c *Copier) WithIgnoreFields(columnKey string, fields ...string) *Copier {
+	c.ignoreFields[columnKey] = fields
+	return c
+}
+
+// Stats returns the progress of every shard, ordered by shard name
+func (c *Copier) Stats() []CopyStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := make([]CopyStats, 0, len(c.stats))
+	for _, shardStats := range c.stats {
+		stats = append(stats, *shardStats)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Shard < stats[j].Shard })
+	return stats
+}
+
+// Run copies every shard of the current layout concurrently, scanning each one up to the cells it
+// held when Run started. Cells written meanwhile, including the copies landing on a shard kept by
+// the new layout, are picked up by the next Run. Failed shards are reported as ShardErrors,
+// running again resumes them from their checkpoint.
+func (c *Copier) Run(ctx context.Context) error {
+	c.kv.mu.RLock()
+	if c.kv.migration == nil {
+		c.kv.mu.RUnlock()
+		return ErrNoMigration
+	}
+	// the maps are copied, as shards may be added or deleted while the copier runs
+	chooser, sources, destinations := c.kv.migration, copyStorages(c.kv.storages), copyStorages(c.kv.mstorages)
+	migration := c.kv.migrationID
+	c.kv.mu.RUnlock()
+
+	// replicas may lag, the copier must see every cell and what destinations already hold
+	ctx = WithReadPolicy(ctx, PrimaryOnly)
+
+	start := time.Now()
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs ShardErrors
+	)
+	fail := func(shard string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if errs == nil {
+			errs = make(ShardErrors)
+		}
+		errs[shard] = err
+	}
+
+	// every shard is measured before any is copied to, as copies may land on a shard kept by the new layout
+	type bounds struct{ after, remaining int64 }
+	scans := make(map[string]bounds, len(sources))
+	for shard, source := range sources {
+		after, err := c.checkpoints.LoadCheckpoint(ctx, copyCheckpoint(migration, shard))
+		if err != nil {
+			fail(shard, err)
+			continue
+		}
+		remaining, err := source.CountCellsAfter(ctx, after)
+		if err != nil {
+			fail(shard, err)
+			continue
+		}
+		scans[shard] = bounds{after: after, remaining: remaining}
+		c.update(shard, func(stats *CopyStats) {
+			stats.Checkpoint, stats.Remaining, stats.Done = after, remaining, false
+		})
+	}
+
+	for shard, scan := range scans {
+		wg.Add(1)
+		go func(shard string, source Storage, after, remaining int64) {
+			defer wg.Done()
+			if err := c.copyShard(ctx, migration, shard, source, after, remaining, chooser, destinations, start); err != nil {
+				fail(shard, err)
+			}
+		}(shard, sources[shard], scan.after, scan.remaining)
+	}
+	wg.Wait()
+
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// copyShard scans the remaining cells of source that follow its checkpoint after
+func (c *Copier) copyShard(ctx context.Context, migration, shard string, source Storage, after, remaining int64, chooser Chooser, destinations map[string]Storage, start time.Time) error {
+	for scanned := int64(0); scanned < remaining; {
+		limit := c.batchSize
+		if left := remaining - scanned; left < int64(limit) {
+			limit = int(left)
+		}
+		cells, found, err := source.ScanCells(ctx, after, limit)
+		if err != nil {
+			return err
+		}
+		if !found {
+			break
+		}
+		// a hole may be filled by a cell committing late, the shard is not done until it was copied
+		n := settled(after, cells, c.gapGrace)
+		if n == 0 {
+			return nil
+		}
+		held := n < len(cells)
+		cells = cells[:n]
+
+		copied, err := c.copyBatch(ctx, shard, cells, chooser, destinations)
+		if err != nil {
+			return err
+		}
+		after = cells[len(cells)-1].AddedAt
+		if err := c.checkpoints.SaveCheckpoint(ctx, copyCheckpoint(migration, shard), after); err != nil {
+			return err
+		}
+		scanned += int64(len(cells))
+		left, err := source.CountCellsAfter(ctx, after)
+		if err != nil {
+			return err
+		}
+
+		c.update(shard, func(stats *CopyStats) {
+			stats.Checkpoint = after
+			stats.Scanned += int64(len(cells))
+			stats.Copied += copied
+			stats.Remaining = left
+			if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+				stats.Throughput = float64(stats.Scanned) / elapsed
+			}
+		})
+		if held {
+			return nil
+		}
+	}
+
+	c.update(shard, func(stats *CopyStats) {
+		stats.Done = true
+	})
+	return nil
+}
+
+// copyBatch writes the cells of shard whose new shard differs, returning how many were written
+func (c *Copier) copyBatch(ctx context.Context, shard string, cells []models.Cell, chooser Chooser, destinations map[string]Storage) (int64, error) {
+	type group struct {
+		destination string
+		columnKey   string
+	}
+
+	groups := make(map[group][]models.Cell)
+	for _, cell := range cells {
+		destination := chooser.Choose(string(cell.RowKey))
+		if destination == shard {
+			continue
+		}
+		key := group{destination: destination, columnKey: cell.ColumnName}
+		groups[key] = append(groups[key], cell)
+	}
+
+	var copied int64
+	for key, group := range groups {
+		n, err := c.copyGroup(ctx, destinations[key.destination], key.columnKey, group)
+		if err != nil {
+			return copied, err
+		}
+		copied += n
+	}
+	return copied, nil
+}
+
+// copyGroup writes cells of a single column to destination, see writeCells
+func (c *Copier) copyGroup(ctx context.Context, destination Storage, columnKey string, cells []models.Cell) (int64, error) {
+	// a ref key written on the new layout during the migration takes precedence over the older copy
+	copied, _, err := writeCells(ctx, destination, columnKey, cells, c.ignoreFields[columnKey])
+	return copied, err
+}
+
+// writeCells writes cells of a single column to destination, skipping those it already holds, and
+// returns how many were written. A cell superseded by a newer version, already on destination or
+// later in cells, is written without touching the index tables, so that they keep following the
+// latest version. Cells whose ref key destination holds with another body are not written but
+// returned as conflicts.
+func writeCells(ctx context.Context, destination Storage, columnKey string, cells []models.Cell, ignoreFields []string) (copied int64, conflicts []models.Cell, err error) {
+	rowKeys := make([][]byte, len(cells))
+	for i, cell := range cells {
+		rowKeys[i] = cell.RowKey
+	}
+	latest, _, err := destination.MultiGetCellLatest(ctx, rowKeys, columnKey)
+	if err != nil {
+		return 0, nil, err
+	}
+	newest := make(map[string]int64)
+	for rowKey, cell := range latest {
+		newest[rowKey] = cell.RefKey
+	}
+	for _, cell := range cells {
+		if refKey, ok := newest[string(cell.RowKey)]; !ok || cell.RefKey > refKey {
+			newest[string(cell.RowKey)] = cell.RefKey
+		}
+	}
+
+	var indexed, superseded []models.Cell
+	for _, cell := range cells {
+		if cell.RefKey < newest[string(cell.RowKey)] {
+			superseded = append(superseded, cell)
+		} else {
+			indexed = append(indexed, cell)
+		}
+	}
+
+	put := func(cell models.Cell, ignoreFields ...string) error {
+		n, err := putIfAbsent(ctx, destination, cell, ignoreFields...)
+		if errors.Is(err, ErrConflictingCell) {
+			conflicts = append(conflicts, cell)
+			return nil
+		}
+		copied += n
+		return err
+	}
+
+	err = destination.PutCells(ctx, indexed, ignoreFields...)
+	switch {
+	case err == nil:
+		copied += int64(len(indexed))
+	case errors.Is(err, ErrDuplicateCell), errors.Is(err, ErrConflictingCell):
+		// some cells were written by an earlier run, write the others one by one
+		for _, cell := range indexed {
+			if err := put(cell, ignoreFields...); err != nil {
+				return copied, conflicts, err
+			}
+		}
+	default:
+		return copied, conflicts, err
+	}
+
+	for _, cell := range superseded {
+		fields, err := bodyFields(cell.Body)
+		if err != nil {
+			return copied, conflicts, err
+		}
+		if err := put(cell, fields...); err != nil {
+			return copied, conflicts, err
+		}
+	}
+	return copied, conflicts, nil
+}
+
+// copyCheckpoint returns the name the checkpoint of shard is saved under during migration
+func copyCheckpoint(migration, shard string) string {
+	return shard + "@" + migration
+}
+
+// update applies fn to the stats of shard under c.mu
+func (c *Copier) update(shard string, fn func(stats *CopyStats)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats, ok := c.stats[shard]
+	if !ok {
+		stats = &CopyStats{Shard: shard}
+		c.stats[shard] = stats
+	}
+	fn(stats)
+}
+
+// putIfAbsent writes cell unless its ref key is taken already, returning 1 if it was written.
+// A ref key taken by another body is reported with ErrConflictingCell.
+func putIfAbsent(ctx context.Context, storage Storage, cell models.Cell, ignoreFields ...string) (int64, error) {
+	existing, found, err := storage.GetCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey)
+	if err != nil {
+		return 0, err
+	}
+	if found {
+		if !bytes.Equal(existing.Body, cell.Body) {
+			return 0, ErrConflictingCell
+		}
+		return 0, nil
+	}
+	if err := storage.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell, ignoreFields...); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// bodyFields returns the top-level fields of a cell body, i.e. every field PutCell would index
+func bodyFields(body []byte) ([]string, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func copyStorages(storages map[string]Storage) map[string]Storage {
+	copied := make(map[string]Storage, len(storages))
+	for shard, storage := range storages {
+		copied[shard] = storage
+	}
+	return copied
+}
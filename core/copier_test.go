@@ -0,0 +1,244 @@
+package core_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.jogchat.internal/go-schemaless/core"
+	"code.jogchat.internal/go-schemaless/models"
+	"code.jogchat.internal/go-schemaless/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopier(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	dir, err := ioutil.TempDir("", "schemaless-copier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkpoints := core.NewFileCheckpointer(filepath.Join(dir, "checkpoints.json"))
+
+	old := []core.Shard{{Name: "shard0", Backend: memory.New()}, {Name: "shard1", Backend: memory.New()}}
+	kv := core.New(old)
+	assert.Equal(core.ErrNoMigration, core.NewCopier(kv, checkpoints).Run(ctx))
+
+	var cells []models.Cell
+	for i := 0; i < 30; i++ {
+		cell := newBusiness(1, "companies", "uber.com", "Uber")
+		assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+		cells = append(cells, cell)
+	}
+	// a second version of the first row, which is the one to be indexed
+	renamed := newBusiness(2, "companies", "ubereats.com", "Uber Eats")
+	renamed.RowKey = cells[0].RowKey
+	assert.NoError(kv.PutCell(ctx, renamed.RowKey, renamed.ColumnName, renamed.RefKey, renamed))
+
+	next := []core.Shard{old[1], {Name: "shard2", Backend: memory.New()}, {Name: "shard3", Backend: memory.New()}}
+	assert.NoError(kv.BeginMigration(next))
+
+	// written during the migration, the copy of older versions must not take its index entry over
+	newest := newBusiness(3, "companies", "uberfreight.com", "Uber Freight")
+	newest.RowKey = cells[1].RowKey
+	assert.NoError(kv.PutCell(ctx, newest.RowKey, newest.ColumnName, newest.RefKey, newest))
+
+	// everything the old layout held when the copier started is scanned once
+	var held int64
+	for _, shard := range old {
+		count, err := shard.Backend.CountCellsAfter(ctx, 0)
+		assert.NoError(err)
+		held += count
+	}
+
+	copier := core.NewCopier(kv, checkpoints).WithBatchSize(4)
+	assert.NoError(copier.Run(ctx))
+
+	stats := copier.Stats()
+	if assert.Len(stats, 2) {
+		var scanned, copied int64
+		for _, shardStats := range stats {
+			assert.True(shardStats.Done)
+			assert.True(shardStats.Checkpoint > 0)
+			scanned += shardStats.Scanned
+			copied += shardStats.Copied
+		}
+		assert.Equal(held, scanned)
+		assert.True(copied > 0 && copied <= scanned)
+	}
+
+	// resuming from the saved checkpoints copies nothing, shard0 only receives writes through the copier
+	resumed := core.NewCopier(kv, checkpoints)
+	assert.NoError(resumed.Run(ctx))
+	for _, shardStats := range resumed.Stats() {
+		assert.Zero(shardStats.Copied, shardStats.Shard)
+		if shardStats.Shard == "shard0" {
+			assert.Zero(shardStats.Scanned)
+		}
+	}
+
+	// starting over copies nothing twice
+	again := core.NewCopier(kv, core.NewMemoryCheckpointer())
+	assert.NoError(again.Run(ctx))
+	for _, shardStats := range again.Stats() {
+		assert.Zero(shardStats.Copied, shardStats.Shard)
+	}
+
+	// the rows are in both layouts, reads during the migration return each once
+	found, err := kv.CheckValueExist(ctx, "companies", "domain", "ubereats.com")
+	assert.NoError(err)
+	assert.True(found)
+	latest, found, err := kv.GetCellByUniqueFieldLatest(ctx, "companies", "domain", "uberfreight.com")
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(newest.Body, latest.Body)
+	matches, _, err := kv.GetCellsByColumnLatest(ctx, "companies")
+	assert.NoError(err)
+	assert.Len(matches, 30)
+
+	assert.NoError(kv.CompleteMigration())
+	for _, cell := range cells[2:] {
+		latest, found, err = kv.GetCellLatest(ctx, cell.RowKey, "companies")
+		assert.NoError(err)
+		assert.True(found)
+		assert.Equal(cell.Body, latest.Body)
+	}
+	versions, _, err := kv.GetCellVersions(ctx, renamed.RowKey, "companies", core.VersionOptions{})
+	assert.NoError(err)
+	assert.Len(versions, 2, "every version is copied")
+
+	// shard1 was kept and still holds the rows that moved off it, they are not returned again
+	matches, _, err = kv.GetCellsByColumnLatest(ctx, "companies")
+	assert.NoError(err)
+	assert.Len(matches, 30)
+	found, err = kv.CheckValueExist(ctx, "companies", "domain", "ubereats.com")
+	assert.NoError(err)
+	assert.True(found)
+	latest, found, err = kv.GetCellByUniqueFieldLatest(ctx, "companies", "domain", "uberfreight.com")
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(newest.Body, latest.Body)
+	matches, _, err = kv.GetCellsByFieldLatest(ctx, "companies", "domain", "uber.com", "=")
+	assert.NoError(err)
+	assert.Len(matches, 28)
+}
+
+func TestCopierReusedCheckpoints(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	shards := []core.Shard{{Name: "shard0", Backend: memory.New()}, {Name: "shard1", Backend: memory.New()}, {Name: "shard2", Backend: memory.New()}}
+	kv := core.New(shards[:1])
+	checkpoints := core.NewMemoryCheckpointer()
+
+	var cells []models.Cell
+	put := func(n int) {
+		for i := 0; i < n; i++ {
+			cell := newBusiness(1, "companies", "uber.com", "Uber")
+			assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+			cells = append(cells, cell)
+		}
+	}
+
+	put(30)
+	assert.NoError(kv.BeginMigration(shards[:2]))
+	first := kv.StatusMigration().ID
+	assert.NoError(core.NewCopier(kv, checkpoints).Run(ctx))
+	assert.NoError(kv.CompleteMigration())
+
+	// shard0 was scanned to its end by the first migration, the rows it keeps may move again
+	put(10)
+	assert.NoError(kv.BeginMigration(shards))
+	assert.NotEqual(first, kv.StatusMigration().ID)
+	assert.NoError(core.NewCopier(kv, checkpoints).Run(ctx))
+	assert.NoError(kv.CompleteMigration())
+
+	for _, cell := range cells {
+		latest, found, err := kv.GetCellLatest(ctx, cell.RowKey, "companies")
+		assert.NoError(err)
+		assert.True(found)
+		assert.Equal(cell.Body, latest.Body)
+	}
+}
+
+func TestCopierResumeAfterRestart(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	dir, err := ioutil.TempDir("", "schemaless-copier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoints.json")
+
+	old := []core.Shard{{Name: "shard0", Backend: memory.New()}, {Name: "shard1", Backend: memory.New()}}
+	next := []core.Shard{old[0], old[1], {Name: "shard2", Backend: memory.New()}}
+	kv := core.New(old)
+	for i := 0; i < 30; i++ {
+		cell := newBusiness(1, "companies", "uber.com", "Uber")
+		assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+	}
+	assert.NoError(kv.BeginMigration(next))
+	id := kv.StatusMigration().ID
+	assert.NoError(core.NewCopier(kv, core.NewFileCheckpointer(path)).Run(ctx))
+
+	// a restarted process begins the same migration again over the same backends
+	restarted := core.New(old)
+	assert.NoError(restarted.BeginMigration(next))
+	assert.Equal(id, restarted.StatusMigration().ID)
+	resumed := core.NewCopier(restarted, core.NewFileCheckpointer(path))
+	assert.NoError(resumed.Run(ctx))
+	if assert.Len(resumed.Stats(), 2) {
+		for _, shardStats := range resumed.Stats() {
+			assert.Zero(shardStats.Scanned, shardStats.Shard)
+			assert.True(shardStats.Done)
+		}
+	}
+
+	// another layout does not pick up these checkpoints
+	assert.NoError(restarted.AbortMigration())
+	assert.NoError(restarted.BeginMigration(old[:1]))
+	assert.NotEqual(id, restarted.StatusMigration().ID)
+}
+
+func TestCopierAddedAtHole(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	var pending int64
+	kv := core.New([]core.Shard{{Name: "shard0", Backend: uncommittedStorage{memory.New(), &pending}}})
+	var cells []models.Cell
+	for i := 0; i < 5; i++ {
+		cell := newBusiness(1, "companies", "uber.com", "Uber")
+		assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+		cells = append(cells, cell)
+	}
+	assert.NoError(kv.BeginMigration([]core.Shard{{Name: "shard1", Backend: memory.New()}}))
+	checkpoints := core.NewMemoryCheckpointer()
+
+	// the copier stops before a recent hole, and is not done with the shard
+	pending = 3
+	copier := core.NewCopier(kv, checkpoints)
+	assert.NoError(copier.Run(ctx))
+	if assert.Len(copier.Stats(), 1) {
+		assert.Equal(int64(2), copier.Stats()[0].Checkpoint)
+		assert.False(copier.Stats()[0].Done)
+	}
+
+	// once the cell committed, the next run copies it
+	pending = 0
+	copier = core.NewCopier(kv, checkpoints)
+	assert.NoError(copier.Run(ctx))
+	assert.True(copier.Stats()[0].Done)
+	assert.NoError(kv.CompleteMigration())
+	for _, cell := range cells {
+		_, found, err := kv.GetCellLatest(ctx, cell.RowKey, "companies")
+		assert.NoError(err)
+		assert.True(found)
+	}
+}
@@ -2,22 +2,38 @@ package core
 
 import (
 	jh "code.jogchat.internal/dgryski-go-shardedkv/choosers/jump"
-	"code.jogchat.internal/go-schemaless/storage/mysql"
 	"context"
+	"errors"
+	"fmt"
+	"math"
 	"code.jogchat.internal/go-schemaless/models"
 	"sync"
+	"sync/atomic"
+	"time"
 	"code.jogchat.internal/dgryski-go-metro"
-	"code.jogchat.internal/golang_backend/utils"
-	"errors"
 )
 
 // KVStore is a sharded key-value store
 type KVStore struct {
 	continuum Chooser
-	storages  map[string]*mysql.Storage
+	storages  map[string]Storage
 
 	migration Chooser
-	mstorages map[string]*mysql.Storage
+	mstorages map[string]Storage
+	// retired holds the shards of the current layout DeleteShard took out during the migration,
+	// AbortMigration puts them back
+	retired map[string]Storage
+	// migrationID, migrationStarted and migrationWrites back StatusMigration, migrationWrites is updated atomically
+	migrationID      string
+	migrationStarted time.Time
+	migrationWrites  int64
+
+	// shardTimeout bounds each shard's part of a cross-shard read, see WithShardTimeout
+	shardTimeout time.Duration
+	// readMode decides whether cross-shard reads fail fast or return partial results, see WithReadMode
+	readMode ReadMode
+	// buffer takes the writes of unavailable shards, see WithBuffer
+	buffer Storage
 
 	// we avoid holding the lock during a call to a storage engine, which may block
 	mu	sync.RWMutex
@@ -33,12 +49,71 @@ type Chooser interface {
 	Buckets() []string
 }
 
+// Storage is a backend capable of holding the cells of one shard
+type Storage interface {
+	// GetCell returns the version of a cell with exactly the given ref key
+	GetCell(ctx context.Context, rowKey []byte, columnKey string, refKey int64) (cell models.Cell, found bool, err error)
+	// GetCellLatest returns the cell with the highest ref key for the given row key and column
+	GetCellLatest(ctx context.Context, rowKey []byte, columnKey string) (cell models.Cell, found bool, err error)
+	// GetCellVersions returns the versions of a cell selected by opts, ordered by ref key
+	GetCellVersions(ctx context.Context, rowKey []byte, columnKey string, opts VersionOptions) (cells []models.Cell, found bool, err error)
+	// GetRowLatest returns the latest cell of each of the given columns of a row, or of all its columns if none are given
+	GetRowLatest(ctx context.Context, rowKey []byte, columns ...string) (cells map[string]models.Cell, found bool, err error)
+	// MultiGetCellLatest returns the latest cell of a column for each of the given rows, keyed by string(rowKey)
+	MultiGetCellLatest(ctx context.Context, rowKeys [][]byte, columnKey string) (cells map[string]models.Cell, found bool, err error)
+	// GetCellsByColumnLatest returns the latest cell of every row holding the given column
+	GetCellsByColumnLatest(ctx context.Context, columnKey string) (cells []models.Cell, found bool, err error)
+	// GetCellsByFieldLatest returns the latest cells whose indexed field matches value under operator
+	GetCellsByFieldLatest(ctx context.Context, columnKey string, field string, value interface{}, operator string) (cells []models.Cell, found bool, err error)
+	// GetCellByUniqueFieldLatest returns the latest cell uniquely identified by an indexed field
+	GetCellByUniqueFieldLatest(ctx context.Context, columnKey string, field string, value interface{}) (cell models.Cell, found bool, err error)
+	// ScanCells returns up to limit cells, of any row and column, whose added_at is greater than after, in added_at order, 0 meaning no limit
+	ScanCells(ctx context.Context, after int64, limit int) (cells []models.Cell, found bool, err error)
+	// CountCellsAfter returns the number of cells whose added_at is greater than after
+	CountCellsAfter(ctx context.Context, after int64) (count int64, err error)
+	// LastAddedAt returns the highest added_at of the cells created before createdBefore, of all cells
+	// if it is the zero time, and 0 if there are none
+	LastAddedAt(ctx context.Context, createdBefore time.Time) (addedAt int64, err error)
+	// LoadCheckpoint returns the added_at saved for consumer in the checkpoint table, 0 if there is none
+	LoadCheckpoint(ctx context.Context, consumer string) (addedAt int64, err error)
+	// SaveCheckpoint records addedAt for consumer in the checkpoint table, replacing what was saved before
+	SaveCheckpoint(ctx context.Context, consumer string, addedAt int64) error
+	// CheckValueExist reports whether value is present in the index of the given column and field
+	CheckValueExist(ctx context.Context, columnKey string, field string, value interface{}) (found bool, err error)
+	// PutCell inserts an immutable cell and indexes every body field not listed in ignoreFields
+	PutCell(ctx context.Context, rowKey []byte, columnKey string, refKey int64, cell models.Cell, ignoreFields ...string) error
+	// PutCellIf inserts cell only if the highest ref key of its row and column is expectedLatestRefKey,
+	// NoRefKey meaning that there must be none, atomically against other PutCellIf calls
+	PutCellIf(ctx context.Context, cell models.Cell, expectedLatestRefKey int64, ignoreFields ...string) error
+	// PutCells inserts a batch of cells atomically, using as few statements as the backend allows
+	PutCells(ctx context.Context, cells []models.Cell, ignoreFields ...string) error
+	// Destroy releases the resources held by the backend
+	Destroy(ctx context.Context) error
+}
+
+// VersionOptions selects the versions returned by GetCellVersions, the zero value selects every version in ascending ref key order
+type VersionOptions struct {
+	// MinRefKey and MaxRefKey bound the ref keys returned, both inclusive, nil leaves that end open
+	MinRefKey *int64
+	MaxRefKey *int64
+	// Limit caps the number of versions returned, 0 means no limit
+	Limit int
+	// Descending returns the newest version first
+	Descending bool
+}
+
 // Shard is a named storage backend
 type Shard struct {
 	Name    string
-	Backend *mysql.Storage
+	Backend Storage
+	// Replicas, if any, are replicated to from Backend, the primary, and serve reads according to ReadPolicy
+	Replicas   []Storage
+	ReadPolicy ReadPolicy
 }
 
+// NoRefKey is the ref key PutCellIf expects when the cell must not exist yet
+const NoRefKey int64 = math.MinInt64
+
 func hash64(b []byte) uint64 { return metro.Hash64(b, 0) }
 
 
@@ -49,20 +124,70 @@ func New(shards []Shard) *KVStore {
 	var buckets []string
 	kv := &KVStore{
 		continuum: chooser,
-		storages:  make(map[string]*mysql.Storage),
+		storages:  make(map[string]Storage),
 		// what about migration?
 	}
 	for _, shard := range shards {
 		buckets = append(buckets, shard.Name)
-		kv.AddShard(shard.Name, shard.Backend)
+		kv.storages[shard.Name] = backendOf(shard)
 	}
 	chooser.SetBuckets(buckets)
 	return kv
 }
 
+// NewWithChooser returns a KVStore that uses chooser, see NewChooser, to shard the keys
+// across the provided shards. The chooser's buckets are set to the shards, in order.
+func NewWithChooser(shards []Shard, chooser Chooser) (*KVStore, error) {
+	kv := &KVStore{
+		continuum: chooser,
+		storages:  make(map[string]Storage),
+	}
+	buckets := make([]string, 0, len(shards))
+	for _, shard := range shards {
+		if _, ok := kv.storages[shard.Name]; ok {
+			return nil, fmt.Errorf("shard %s listed twice", shard.Name)
+		}
+		buckets = append(buckets, shard.Name)
+		kv.storages[shard.Name] = backendOf(shard)
+	}
+	if err := chooser.SetBuckets(buckets); err != nil {
+		return nil, err
+	}
+	return kv, nil
+}
+
+// NewWithShardMap returns a KVStore that hashes row keys onto the logical shards of m,
+// which it maps onto the provided shards. Every shard m assigns logical shards to must be provided.
+func NewWithShardMap(shards []Shard, m *ShardMap) (*KVStore, error) {
+	kv := &KVStore{
+		storages: make(map[string]Storage),
+	}
+	for _, shard := range shards {
+		kv.storages[shard.Name] = backendOf(shard)
+	}
+	chooser, err := newShardMapChooser(m, kv.storages)
+	if err != nil {
+		return nil, err
+	}
+	kv.continuum = chooser
+	return kv, nil
+}
+
+// ShardMap returns a copy of the shard map of the current layout, nil if it is not sharded through one
+func (kv *KVStore) ShardMap() *ShardMap {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	chooser, ok := kv.continuum.(*shardMapChooser)
+	if !ok {
+		return nil
+	}
+	return chooser.m.clone()
+}
+
 func (kv *KVStore) GetCellLatest(ctx context.Context, rowKey []byte, columnKey string) (cell models.Cell, found bool, err error) {
-	var storage *mysql.Storage
-	var migStorage *mysql.Storage
+	var storage Storage
+	var migStorage Storage
 
 	kv.mu.RLock()
 	defer kv.mu.RUnlock()
@@ -73,7 +198,7 @@ func (kv *KVStore) GetCellLatest(ctx context.Context, rowKey []byte, columnKey s
 	}
 
 	if migStorage != nil {
-		val, ok, err := (*migStorage).GetCellLatest(ctx, rowKey, columnKey)
+		val, ok, err := migStorage.GetCellLatest(ctx, rowKey, columnKey)
 		if err != nil {
 			return val, ok, err
 		}
@@ -84,97 +209,303 @@ func (kv *KVStore) GetCellLatest(ctx context.Context, rowKey []byte, columnKey s
 
 	shard := kv.continuum.Choose(string(rowKey))
 	storage = kv.storages[shard]
+	if storage == nil {
+		// retired by DeleteShard during the migration
+		return cell, false, nil
+	}
 
-	return (*storage).GetCellLatest(ctx, rowKey, columnKey)
+	return storage.GetCellLatest(ctx, rowKey, columnKey)
 }
 
-// get cell with specific field, cell must be uniquely identified by field
-func (kv *KVStore) GetCellByUniqueFieldLatest(ctx context.Context, columnKey string, field string, value interface{}) (cell models.Cell, found bool, err error) {
+// GetCell returns the version of a cell with exactly the given ref key
+func (kv *KVStore) GetCell(ctx context.Context, rowKey []byte, columnKey string, refKey int64) (cell models.Cell, found bool, err error) {
+	var storage Storage
+	var migStorage Storage
+
 	kv.mu.RLock()
 	defer kv.mu.RUnlock()
 
-	count := 0
-	for _, storage := range kv.storages {
-		cell_, found, err := (*storage).GetCellByUniqueFieldLatest(ctx, columnKey, field, value)
-		if found {
-			utils.CheckErr(err)
-			count += 1
-			if count > 1 {
-				return cell, false, errors.New("not unique field")
-			}
-			cell = cell_
+	if kv.migration != nil {
+		shard := kv.migration.Choose(string(rowKey))
+		migStorage = kv.mstorages[shard]
+	}
+
+	if migStorage != nil {
+		val, ok, err := migStorage.GetCell(ctx, rowKey, columnKey, refKey)
+		if err != nil {
+			return val, ok, err
+		}
+		if ok {
+			return val, ok, nil
 		}
 	}
-	if count > 0 {
-		found = true
+
+	shard := kv.continuum.Choose(string(rowKey))
+	storage = kv.storages[shard]
+	if storage == nil {
+		// retired by DeleteShard during the migration
+		return cell, false, nil
 	}
-	return cell, found, nil
+
+	return storage.GetCell(ctx, rowKey, columnKey, refKey)
 }
 
-// get all latest cells with a specific value from column
-func (kv *KVStore) GetCellsByFieldLatest(ctx context.Context, columnKey string, field string, value interface{}, operator string) (cells []models.Cell, found bool, err error) {
+// GetCellVersions returns the versions of a cell selected by opts, ordered by ref key.
+// While a migration is in progress versions may live on both layouts, so both are read and merged.
+func (kv *KVStore) GetCellVersions(ctx context.Context, rowKey []byte, columnKey string, opts VersionOptions) (cells []models.Cell, found bool, err error) {
+	var storage Storage
+	var migStorage Storage
+
 	kv.mu.RLock()
 	defer kv.mu.RUnlock()
 
-	for _, storage := range kv.storages {
-		cells_, found, err := (*storage).GetCellsByFieldLatest(ctx, columnKey, field, value, operator)
-		if found {
-			utils.CheckErr(err)
-			cells = append(cells, cells_...)
+	if kv.migration != nil {
+		shard := kv.migration.Choose(string(rowKey))
+		migStorage = kv.mstorages[shard]
+	}
+
+	shard := kv.continuum.Choose(string(rowKey))
+	storage = kv.storages[shard]
+
+	if storage == nil {
+		// retired by DeleteShard during the migration
+		return migStorage.GetCellVersions(ctx, rowKey, columnKey, opts)
+	}
+	if migStorage == nil || migStorage == storage {
+		return storage.GetCellVersions(ctx, rowKey, columnKey, opts)
+	}
+
+	migCells, _, err := migStorage.GetCellVersions(ctx, rowKey, columnKey, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	cells, _, err = storage.GetCellVersions(ctx, rowKey, columnKey, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	cells = mergeVersions(migCells, cells, opts)
+	return cells, len(cells) > 0, nil
+}
+
+// mergeVersions merges two version lists sorted per opts, dropping ref keys present in both and applying opts.Limit
+func mergeVersions(a, b []models.Cell, opts VersionOptions) []models.Cell {
+	before := func(x, y models.Cell) bool {
+		if opts.Descending {
+			return x.RefKey > y.RefKey
 		}
+		return x.RefKey < y.RefKey
 	}
 
-	found = true
-	if len(cells) == 0 {
-		found = false
+	var merged []models.Cell
+	for len(a) > 0 || len(b) > 0 {
+		if opts.Limit > 0 && len(merged) == opts.Limit {
+			break
+		}
+		var next models.Cell
+		switch {
+		case len(b) == 0 || (len(a) > 0 && before(a[0], b[0])):
+			next, a = a[0], a[1:]
+		case len(a) == 0 || before(b[0], a[0]):
+			next, b = b[0], b[1:]
+		default:
+			// the same version on both layouts, e.g. already copied to the new one
+			next, a, b = a[0], a[1:], b[1:]
+		}
+		merged = append(merged, next)
 	}
-	return cells, found, nil
+	return merged
 }
 
-// get all latest cells with a specific column name
-func (kv *KVStore) GetCellsByColumnLatest(ctx context.Context, columnKey string) (cells []models.Cell, found bool, err error) {
+// GetRowLatest returns the latest cell of each of the given columns of a row, keyed by column name.
+// Without columns, every column of the row is returned. The row is read with a single query to its shard.
+func (kv *KVStore) GetRowLatest(ctx context.Context, rowKey []byte, columns ...string) (cells map[string]models.Cell, found bool, err error) {
+	var storage Storage
+	var migStorage Storage
+
 	kv.mu.RLock()
 	defer kv.mu.RUnlock()
 
-	for _, storage := range kv.storages {
-		cells_, found, err := (*storage).GetCellsByColumnLatest(ctx, columnKey)
-		if found {
-			utils.CheckErr(err)
-			cells = append(cells, cells_...)
-		}
+	if kv.migration != nil {
+		shard := kv.migration.Choose(string(rowKey))
+		migStorage = kv.mstorages[shard]
 	}
 
-	found = true
-	if len(cells) == 0 {
-		found = false
+	shard := kv.continuum.Choose(string(rowKey))
+	storage = kv.storages[shard]
+
+	if storage == nil {
+		// retired by DeleteShard during the migration
+		return migStorage.GetRowLatest(ctx, rowKey, columns...)
 	}
-	return cells, found, nil
+	if migStorage == nil || migStorage == storage {
+		return storage.GetRowLatest(ctx, rowKey, columns...)
+	}
+
+	// columns written since the migration began live on the new layout, the rest on the old one
+	cells, _, err = storage.GetRowLatest(ctx, rowKey, columns...)
+	if err != nil {
+		return nil, false, err
+	}
+	migCells, _, err := migStorage.GetRowLatest(ctx, rowKey, columns...)
+	if err != nil {
+		return nil, false, err
+	}
+	if cells == nil {
+		cells = make(map[string]models.Cell)
+	}
+	for column, cell := range migCells {
+		if old, ok := cells[column]; !ok || cell.RefKey >= old.RefKey {
+			cells[column] = cell
+		}
+	}
+	return cells, len(cells) > 0, nil
 }
 
-// Caution: if checking duplicate UUID, convert UUID to byte array before passing it to value
-func (kv *KVStore) CheckValueExist(ctx context.Context, columnKey string, field string, value interface{}) (exist bool, err error) {
+// MultiGetCellLatest returns the latest cell of a column for each of the given rows, keyed by string(rowKey).
+// Row keys are routed with the chooser and each shard receives a single query, all shards being queried concurrently.
+// Failing shards are reported as ShardErrors, see WithReadMode.
+func (kv *KVStore) MultiGetCellLatest(ctx context.Context, rowKeys [][]byte, columnKey string) (cells map[string]models.Cell, found bool, err error) {
 	kv.mu.RLock()
 	defer kv.mu.RUnlock()
 
-	exist = false
-	err = nil
+	cells, err = kv.multiGetCellLatest(ctx, kv.continuum, kv.storages, rowKeys, columnKey)
+	if cells == nil {
+		return nil, false, err
+	}
+
+	if kv.migration != nil {
+		// cells written since the migration began live on the new layout
+		migCells, migErr := kv.multiGetCellLatest(ctx, kv.migration, kv.mstorages, rowKeys, columnKey)
+		if migCells == nil {
+			return nil, false, migErr
+		}
+		for rowKey, cell := range migCells {
+			if old, ok := cells[rowKey]; !ok || cell.RefKey >= old.RefKey {
+				cells[rowKey] = cell
+			}
+		}
+		err = mergeShardErrors(err, migErr)
+	}
+	return cells, len(cells) > 0, err
+}
 
-	for _, storage := range kv.storages {
-		exist_, err_ := storage.CheckValueExist(ctx, columnKey, field, value)
-		if exist_ {
-			exist = true
+// multiGetCellLatest routes rowKeys with chooser and queries every shard involved concurrently.
+// The map is nil only when the read failed as a whole. Callers must hold kv.mu.
+func (kv *KVStore) multiGetCellLatest(ctx context.Context, chooser Chooser, storages map[string]Storage, rowKeys [][]byte, columnKey string) (map[string]models.Cell, error) {
+	groups := make(map[string][][]byte)
+	involved := make(map[string]Storage)
+	for _, rowKey := range rowKeys {
+		shard := chooser.Choose(string(rowKey))
+		storage, ok := storages[shard]
+		if !ok {
+			// retired by DeleteShard during a migration
+			continue
 		}
-		if err_ != nil {
-			err = err_
+		groups[shard] = append(groups[shard], rowKey)
+		involved[shard] = storage
+	}
+
+	found, _, err := kv.gather(ctx, kv.scatter(ctx, involved, func(ctx context.Context, shard string, storage Storage) ([]models.Cell, bool, error) {
+		latest, found, err := storage.MultiGetCellLatest(ctx, groups[shard], columnKey)
+		cells := make([]models.Cell, 0, len(latest))
+		for _, cell := range latest {
+			cells = append(cells, cell)
+		}
+		return cells, found, err
+	}))
+	if err != nil && kv.readModeOf(ctx) == FailFast {
+		return nil, err
+	}
+
+	cells := make(map[string]models.Cell)
+	for _, cell := range found {
+		cells[string(cell.RowKey)] = cell
+	}
+	return cells, err
+}
+
+// get cell with specific field, cell must be uniquely identified by field.
+// Shards are queried concurrently and the outstanding ones are cancelled as soon as a second match shows up.
+func (kv *KVStore) GetCellByUniqueFieldLatest(ctx context.Context, columnKey string, field string, value interface{}) (cell models.Cell, found bool, err error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		matched = make(map[string]bool)
+	)
+	results := kv.scatter(ctx, kv.readStorages(), func(ctx context.Context, shard string, storage Storage) ([]models.Cell, bool, error) {
+		// every match is asked for, a shard may still hold rows a migration moved off it
+		cells, found, err := storage.GetCellsByFieldLatest(ctx, columnKey, field, value, "=")
+		if found {
+			mu.Lock()
+			for _, cell := range cells {
+				// rows moved off a shard by a migration may answer from there too
+				if kv.owns(shard, cell.RowKey) {
+					matched[string(cell.RowKey)] = true
+				}
+			}
+			if len(matched) > 1 {
+				cancel()
+			}
+			mu.Unlock()
 		}
+		return cells, found, err
+	})
+
+	if len(matched) > 1 {
+		return cell, false, ErrNotUnique
 	}
+	// with BestEffort a match may come back along with the errors of other shards
+	cells, found, err := kv.gather(ctx, results)
+	if !found {
+		return cell, false, err
+	}
+	return cells[0], true, err
+}
+
+// get all latest cells with a specific value from column
+func (kv *KVStore) GetCellsByFieldLatest(ctx context.Context, columnKey string, field string, value interface{}, operator string) (cells []models.Cell, found bool, err error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	return kv.gather(ctx, kv.scatter(ctx, kv.readStorages(), func(ctx context.Context, shard string, storage Storage) ([]models.Cell, bool, error) {
+		return storage.GetCellsByFieldLatest(ctx, columnKey, field, value, operator)
+	}))
+}
+
+// get all latest cells with a specific column name
+func (kv *KVStore) GetCellsByColumnLatest(ctx context.Context, columnKey string) (cells []models.Cell, found bool, err error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	return kv.gather(ctx, kv.scatter(ctx, kv.readStorages(), func(ctx context.Context, shard string, storage Storage) ([]models.Cell, bool, error) {
+		return storage.GetCellsByColumnLatest(ctx, columnKey)
+	}))
+}
+
+// Caution: if checking duplicate UUID, convert UUID to byte array before passing it to value
+func (kv *KVStore) CheckValueExist(ctx context.Context, columnKey string, field string, value interface{}) (exist bool, err error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
 
+	_, exist, err = kv.gather(ctx, kv.scatter(ctx, kv.readStorages(), func(ctx context.Context, shard string, storage Storage) ([]models.Cell, bool, error) {
+		found, err := storage.CheckValueExist(ctx, columnKey, field, value)
+		if !found || err != nil {
+			return nil, found, err
+		}
+		// the matching cells are needed to tell whether their shard still owns them
+		return storage.GetCellsByFieldLatest(ctx, columnKey, field, value, "=")
+	}))
 	return exist, err
 }
 
 // insert cell, remember to pass in all fields that you do not want to index on
 func (kv *KVStore) PutCell(ctx context.Context, rowKey []byte, columnKey string, refKey int64, cell models.Cell, ignore_fields ...string) error {
-	var storage *mysql.Storage
+	var storage Storage
 
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
@@ -183,13 +514,197 @@ func (kv *KVStore) PutCell(ctx context.Context, rowKey []byte, columnKey string,
 		shard := kv.migration.Choose(string(rowKey))
 		storage = kv.mstorages[shard]
 
-		return (*storage).PutCell(ctx, rowKey, columnKey, refKey, cell, ignore_fields...)
+		err := storage.PutCell(ctx, rowKey, columnKey, refKey, cell, ignore_fields...)
+		if err == nil {
+			atomic.AddInt64(&kv.migrationWrites, 1)
+		}
+		return kv.bufferOnFailure(err, func(buffer Storage) error {
+			return buffer.PutCell(ctx, rowKey, columnKey, refKey, cell, ignore_fields...)
+		})
 	}
 
 	shard := kv.continuum.Choose(string(rowKey))
 	storage = kv.storages[shard]
 
-	return (*storage).PutCell(ctx, rowKey, columnKey, refKey, cell, ignore_fields...)
+	err := storage.PutCell(ctx, rowKey, columnKey, refKey, cell, ignore_fields...)
+	return kv.bufferOnFailure(err, func(buffer Storage) error {
+		return buffer.PutCell(ctx, rowKey, columnKey, refKey, cell, ignore_fields...)
+	})
+}
+
+// PutCellIf inserts cell, identified by its own RowKey, ColumnName and RefKey, only if the highest
+// ref key of its row and column is expectedLatestRefKey, or NoRefKey for a cell that must not exist yet.
+// The check and the write are atomic on the owning shard, ErrPreconditionFailed is returned otherwise,
+// as it is for a cell whose ref key does not follow expectedLatestRefKey, which would not become the latest.
+// Writes to unavailable shards are not buffered, as the precondition cannot be checked.
+func (kv *KVStore) PutCellIf(ctx context.Context, cell models.Cell, expectedLatestRefKey int64, ignoreFields ...string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	return kv.putCellIf(ctx, cell, expectedLatestRefKey, ignoreFields...)
+}
+
+// maxAppendAttempts bounds the ref keys AppendCell tries when other writers keep taking them first
+const maxAppendAttempts = 10
+
+// AppendCell writes body as the next version of a row and column, assigning it the ref key
+// following the highest one written so far, or 1 for the first version. The ref key is taken
+// atomically on the owning shard, see PutCellIf, and is returned in the written cell.
+func (kv *KVStore) AppendCell(ctx context.Context, rowKey []byte, columnKey string, body []byte, ignoreFields ...string) (models.Cell, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < maxAppendAttempts; attempt++ {
+		var latest int64
+		latest, err = kv.latestRefKey(ctx, rowKey, columnKey)
+		if err != nil {
+			return models.Cell{}, err
+		}
+		refKey := int64(1)
+		if latest != NoRefKey {
+			if latest == math.MaxInt64 {
+				return models.Cell{}, fmt.Errorf("no ref key left after %d", latest)
+			}
+			refKey = latest + 1
+		}
+
+		cell := models.NewCell(rowKey, columnKey, refKey, body)
+		err = kv.putCellIf(ctx, cell, latest, ignoreFields...)
+		if !errors.Is(err, ErrPreconditionFailed) {
+			if err != nil {
+				return models.Cell{}, err
+			}
+			return cell, nil
+		}
+	}
+	return models.Cell{}, err
+}
+
+// latestRefKey returns the highest ref key of a row and column on the primaries of its shards,
+// including the old one during a migration, or NoRefKey if there is none. Callers must hold kv.mu.
+func (kv *KVStore) latestRefKey(ctx context.Context, rowKey []byte, columnKey string) (int64, error) {
+	ctx = WithReadPolicy(ctx, PrimaryOnly)
+	var storages []Storage
+	// nil when retired by DeleteShard during a migration
+	if storage := kv.storages[kv.continuum.Choose(string(rowKey))]; storage != nil {
+		storages = append(storages, storage)
+	}
+	if kv.migration != nil {
+		storages = append(storages, kv.mstorages[kv.migration.Choose(string(rowKey))])
+	}
+
+	latest := NoRefKey
+	for _, storage := range storages {
+		cell, found, err := storage.GetCellLatest(ctx, rowKey, columnKey)
+		if err != nil {
+			return NoRefKey, err
+		}
+		if found && cell.RefKey > latest {
+			latest = cell.RefKey
+		}
+	}
+	return latest, nil
+}
+
+// putCellIf implements PutCellIf, callers must hold kv.mu
+func (kv *KVStore) putCellIf(ctx context.Context, cell models.Cell, expectedLatestRefKey int64, ignoreFields ...string) error {
+	if cell.RefKey <= expectedLatestRefKey {
+		return fmt.Errorf("%w: ref key %d does not follow %d", ErrPreconditionFailed, cell.RefKey, expectedLatestRefKey)
+	}
+	if kv.migration == nil {
+		storage := kv.storages[kv.continuum.Choose(string(cell.RowKey))]
+		return storage.PutCellIf(ctx, cell, expectedLatestRefKey, ignoreFields...)
+	}
+
+	// the latest version may not have been copied to the new layout yet, and replicas may lag
+	storage := kv.mstorages[kv.migration.Choose(string(cell.RowKey))]
+	latest, found, err := storage.GetCellLatest(WithReadPolicy(ctx, PrimaryOnly), cell.RowKey, cell.ColumnName)
+	if err != nil {
+		return err
+	}
+	expected := NoRefKey
+	if found {
+		expected = latest.RefKey
+	}
+	overall, err := kv.latestRefKey(ctx, cell.RowKey, cell.ColumnName)
+	if err != nil {
+		return err
+	}
+	if overall != expectedLatestRefKey {
+		return ErrPreconditionFailed
+	}
+
+	// the new shard must still hold what was checked against
+	if err := storage.PutCellIf(ctx, cell, expected, ignoreFields...); err != nil {
+		return err
+	}
+	atomic.AddInt64(&kv.migrationWrites, 1)
+	return nil
+}
+
+// PutCells inserts cells, identified by their own RowKey, ColumnName and RefKey, grouping them
+// by shard so that each shard receives a single batch. The returned slice holds one error per
+// cell in the order given, nil for cells that were written; err is the first failure, if any.
+// A batch refused for a duplicate or conflicting cell is written again cell by cell, so that
+// only the offending cells fail.
+func (kv *KVStore) PutCells(ctx context.Context, cells []models.Cell, ignoreFields ...string) (results []error, err error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	chooser, storages := kv.continuum, kv.storages
+	if kv.migration != nil {
+		chooser, storages = kv.migration, kv.mstorages
+	}
+
+	groups := make(map[string][]int)
+	for i, cell := range cells {
+		shard := chooser.Choose(string(cell.RowKey))
+		groups[shard] = append(groups[shard], i)
+	}
+
+	results = make([]error, len(cells))
+	var wg sync.WaitGroup
+	for shard, indexes := range groups {
+		wg.Add(1)
+		go func(storage Storage, indexes []int) {
+			defer wg.Done()
+			put := func(group []models.Cell) error {
+				err := storage.PutCells(ctx, group, ignoreFields...)
+				err = kv.bufferOnFailure(err, func(buffer Storage) error {
+					return buffer.PutCells(ctx, group, ignoreFields...)
+				})
+				if err == nil && kv.migration != nil {
+					atomic.AddInt64(&kv.migrationWrites, int64(len(group)))
+				}
+				return err
+			}
+
+			group := make([]models.Cell, len(indexes))
+			for j, i := range indexes {
+				group[j] = cells[i]
+			}
+			groupErr := put(group)
+			if errors.Is(groupErr, ErrDuplicateCell) || errors.Is(groupErr, ErrConflictingCell) {
+				// the batch was rolled back as a whole, the cells it did not fail for are written on their own
+				for j, i := range indexes {
+					results[i] = put(group[j : j+1])
+				}
+				return
+			}
+			for _, i := range indexes {
+				results[i] = groupErr
+			}
+		}(storages[shard], indexes)
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		if result != nil {
+			return results, result
+		}
+	}
+	return results, nil
 }
 
 // Destroy implements Storage.Destroy()
@@ -199,7 +714,7 @@ func (kv *KVStore) Destroy(ctx context.Context) error {
 
 	if kv.migration != nil {
 		for _, migStorage := range kv.mstorages {
-			err := (*migStorage).Destroy(ctx)
+			err := migStorage.Destroy(ctx)
 			if err != nil {
 				return err
 			}
@@ -207,7 +722,7 @@ func (kv *KVStore) Destroy(ctx context.Context) error {
 		return nil
 	}
 	for _, store := range kv.storages {
-		err := (*store).Destroy(ctx)
+		err := store.Destroy(ctx)
 		if err != nil {
 			return err
 		}
@@ -215,18 +730,119 @@ func (kv *KVStore) Destroy(ctx context.Context) error {
 	return nil
 }
 
-// AddShard adds a shard from the list of known shards
-func (kv *KVStore) AddShard(shard string, storage *mysql.Storage) {
+// ShardFor returns the name of the shard rowKey is written to, on the new layout during a migration
+func (kv *KVStore) ShardFor(rowKey []byte) string {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	if kv.migration != nil {
+		return kv.migration.Choose(string(rowKey))
+	}
+	return kv.continuum.Choose(string(rowKey))
+}
+
+// AddShard adds a shard to the current layout once it answers a probe, and routes rows to it
+// right away. Rows already written would be left behind on the shards the chooser no longer sends
+// them to, so a store holding cells refuses with ErrShardNotEmpty, grow it with a migration instead.
+func (kv *KVStore) AddShard(ctx context.Context, shard string, storage Storage) error {
+	if shard == "" {
+		return errors.New("shards must be named")
+	}
+	if _, _, err := storage.ScanCells(ctx, 0, 1); err != nil {
+		return fmt.Errorf("shard %s: %w", shard, err)
+	}
+
+	// writes wait until the shards were probed, so none can land before the layout changes
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
 
+	if _, ok := kv.storages[shard]; ok {
+		return fmt.Errorf("shard %s already added", shard)
+	}
+	if kv.migration != nil {
+		return ErrMigrationInProgress
+	}
+	for name, existing := range kv.storages {
+		_, found, err := existing.ScanCells(WithReadPolicy(ctx, PrimaryOnly), 0, 1)
+		if err != nil {
+			return fmt.Errorf("shard %s: %w", name, err)
+		}
+		if found {
+			return fmt.Errorf("shard %s: %w", name, ErrShardNotEmpty)
+		}
+	}
+	// appending keeps the existing buckets in place, which jump hash needs to only move rows to the new shard
+	buckets := append(append([]string(nil), kv.continuum.Buckets()...), shard)
+	if err := kv.continuum.SetBuckets(buckets); err != nil {
+		return err
+	}
 	kv.storages[shard] = storage
+	return nil
 }
 
-// DeleteShard removes a shard from the list of known shards
-func (kv *KVStore) DeleteShard(shard string) {
+// DeleteShard removes a shard from the current layout and stops routing rows to it. During a migration
+// a shard the new layout leaves out may go even while it holds cells, whatever was not copied off it
+// yet is no longer read, and AbortMigration brings it back. Otherwise the shard must be empty, or
+// ErrShardNotEmpty is returned, and the other shards must keep their rows: with jump hash only the
+// shard added last can go, with key ranges split by weight or a custom chooser only from a store
+// holding no cells at all. Use a migration to remove any other. The backend is left for the caller to Destroy.
+func (kv *KVStore) DeleteShard(ctx context.Context, shard string) error {
+	// writes wait until the shards were probed, so none can land on a shard about to go
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
 
+	storage, ok := kv.storages[shard]
+	if !ok {
+		return fmt.Errorf("unknown shard %s", shard)
+	}
+	if len(kv.storages) == 1 {
+		return fmt.Errorf("shard %s is the last one", shard)
+	}
+	if kv.migration != nil {
+		if _, ok := kv.mstorages[shard]; ok {
+			return ErrMigrationInProgress
+		}
+		if kv.retired == nil {
+			kv.retired = make(map[string]Storage)
+		}
+		kv.retired[shard] = storage
+		delete(kv.storages, shard)
+		return nil
+	}
+
+	// a lagging replica could look empty
+	ctx = WithReadPolicy(ctx, PrimaryOnly)
+	_, found, err := storage.ScanCells(ctx, 0, 1)
+	if err != nil {
+		return fmt.Errorf("shard %s: %w", shard, err)
+	}
+	if found {
+		return fmt.Errorf("shard %s: %w", shard, ErrShardNotEmpty)
+	}
+	if !removable(kv.continuum, shard) {
+		for name, other := range kv.storages {
+			if name == shard {
+				continue
+			}
+			_, found, err := other.ScanCells(ctx, 0, 1)
+			if err != nil {
+				return fmt.Errorf("shard %s: %w", name, err)
+			}
+			if found {
+				return fmt.Errorf("removing shard %s would move the rows of shard %s, remove it with a migration", shard, name)
+			}
+		}
+	}
+
+	var buckets []string
+	for _, bucket := range kv.continuum.Buckets() {
+		if bucket != shard {
+			buckets = append(buckets, bucket)
+		}
+	}
+	if err := kv.continuum.SetBuckets(buckets); err != nil {
+		return err
+	}
 	delete(kv.storages, shard)
+	return nil
 }
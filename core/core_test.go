@@ -0,0 +1,445 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"code.jogchat.internal/go-schemaless/core"
+	"code.jogchat.internal/go-schemaless/models"
+	"code.jogchat.internal/go-schemaless/storage/memory"
+	"code.jogchat.internal/go-schemaless/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func newMemoryStore() *core.KVStore {
+	return core.New([]core.Shard{
+		{Name: "shard0", Backend: memory.New()},
+		{Name: "shard1", Backend: memory.New()},
+		{Name: "shard2", Backend: memory.New()},
+	})
+}
+
+func newBusiness(refKey int64, colKey string, domain string, name string) models.Cell {
+	blob, err := json.Marshal(map[string]interface{}{
+		"id":     utils.NewUUID(),
+		"domain": domain,
+		"name":   name,
+	})
+	utils.CheckErr(err)
+	return models.NewCell(utils.NewUUID().Bytes(), colKey, refKey, blob)
+}
+
+func TestKVStoreInMemory(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	kv := newMemoryStore()
+	defer kv.Destroy(ctx)
+
+	cells := []models.Cell{
+		newBusiness(1, "schools", "illinois.edu", "UIUC"),
+		newBusiness(1, "schools", "andrew.cmu.edu", "CMU"),
+		newBusiness(1, "companies", "siftscience.com", "Sift Science"),
+		newBusiness(1, "companies", "yahoo-inc.com", "Yahoo!"),
+	}
+	for _, cell := range cells {
+		assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+	}
+
+	found, _, err := kv.GetCellsByFieldLatest(ctx, "schools", "domain", "illinois.edu", "=")
+	assert.NoError(err)
+	if assert.Len(found, 1) {
+		var body map[string]interface{}
+		assert.NoError(json.Unmarshal(found[0].Body, &body))
+		assert.Equal("UIUC", body["name"])
+	}
+
+	found, ok, err := kv.GetCellsByColumnLatest(ctx, "companies")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Len(found, 2)
+
+	cell, ok, err := kv.GetCellByUniqueFieldLatest(ctx, "companies", "name", "Yahoo!")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(cells[3].RowKey, cell.RowKey)
+
+	exist, err := kv.CheckValueExist(ctx, "schools", "domain", "andrew.cmu.edu")
+	assert.NoError(err)
+	assert.True(exist)
+
+	// a higher ref key supersedes the previous version
+	UIUC := cells[0]
+	UIUC.RefKey = 2
+	UIUC.Body = []byte(`{"domain":"illinois.edu","name":"University of Illinois"}`)
+	assert.NoError(kv.PutCell(ctx, UIUC.RowKey, UIUC.ColumnName, UIUC.RefKey, UIUC))
+
+	cell, ok, err = kv.GetCellLatest(ctx, UIUC.RowKey, "schools")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(int64(2), cell.RefKey)
+	assert.Equal(UIUC.Body, cell.Body)
+
+	// older versions stay readable by ref key
+	cell, ok, err = kv.GetCell(ctx, UIUC.RowKey, "schools", 1)
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(cells[0].Body, cell.Body)
+
+	versions, ok, err := kv.GetCellVersions(ctx, UIUC.RowKey, "schools", core.VersionOptions{Descending: true})
+	assert.NoError(err)
+	assert.True(ok)
+	if assert.Len(versions, 2) {
+		assert.Equal(int64(2), versions[0].RefKey)
+		assert.Equal(int64(1), versions[1].RefKey)
+	}
+
+	assert.NoError(kv.PutCell(ctx, UIUC.RowKey, "rankings", 1, models.NewCell(UIUC.RowKey, "rankings", 1, []byte(`{"rank":1}`)), "rank"))
+	row, ok, err := kv.GetRowLatest(ctx, UIUC.RowKey)
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Len(row, 2)
+	assert.Equal(int64(2), row["schools"].RefKey)
+	assert.Equal(int64(1), row["rankings"].RefKey)
+
+	batch := []models.Cell{
+		newBusiness(1, "companies", "google.com", "Google"),
+		newBusiness(1, "companies", "uber.com", "Uber"),
+		newBusiness(1, "companies", "lyft.com", "Lyft"),
+		cells[2],
+	}
+	results, err := kv.PutCells(ctx, batch)
+	assert.True(errors.Is(err, core.ErrDuplicateCell), "Sift Science was written already")
+	if assert.Len(results, 4) {
+		assert.True(errors.Is(results[3], core.ErrDuplicateCell))
+	}
+	// the other cells of its shard's batch are written all the same
+	for i, cell := range batch[:3] {
+		assert.NoError(results[i])
+		_, ok, err = kv.GetCellLatest(ctx, cell.RowKey, "companies")
+		assert.NoError(err)
+		assert.True(ok)
+	}
+
+	var rowKeys [][]byte
+	for _, cell := range cells {
+		rowKeys = append(rowKeys, cell.RowKey)
+	}
+	latest, ok, err := kv.MultiGetCellLatest(ctx, rowKeys, "schools")
+	assert.NoError(err)
+	assert.True(ok)
+	if assert.Len(latest, 2) {
+		assert.Equal(int64(2), latest[string(UIUC.RowKey)].RefKey)
+		assert.Equal(int64(1), latest[string(cells[1].RowKey)].RefKey)
+	}
+
+	_, ok, err = kv.GetCellLatest(ctx, utils.NewUUID().Bytes(), "schools")
+	assert.NoError(err)
+	assert.False(ok)
+}
+
+// unreachableStorage fails every scan, as a shard whose host is down would
+type unreachableStorage struct {
+	*memory.Storage
+}
+
+func (s unreachableStorage) ScanCells(ctx context.Context, after int64, limit int) ([]models.Cell, bool, error) {
+	return nil, false, core.ErrShardUnavailable
+}
+
+func TestAddDeleteShard(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	kv := core.New([]core.Shard{{Name: "shard0", Backend: memory.New()}})
+	assert.True(errors.Is(kv.AddShard(ctx, "down", unreachableStorage{memory.New()}), core.ErrShardUnavailable))
+	assert.Error(kv.AddShard(ctx, "shard0", memory.New()), "already added")
+
+	// an empty shard goes, and rows no longer reach it
+	assert.NoError(kv.AddShard(ctx, "shard2", memory.New()))
+	assert.NoError(kv.DeleteShard(ctx, "shard2"))
+	for i := 0; i < 50; i++ {
+		cell := newBusiness(1, "companies", "uber.com", "Uber")
+		assert.NotEqual("shard2", kv.ShardFor(cell.RowKey))
+	}
+
+	// an added shard receives its share of the rows
+	shard1 := memory.New()
+	assert.NoError(kv.AddShard(ctx, "shard1", shard1))
+	var routed int
+	for i := 0; i < 50; i++ {
+		cell := newBusiness(1, "companies", "uber.com", "Uber")
+		if kv.ShardFor(cell.RowKey) != "shard1" {
+			continue
+		}
+		routed++
+		assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+		_, found, err := shard1.GetCellLatest(ctx, cell.RowKey, "companies")
+		assert.NoError(err)
+		assert.True(found)
+	}
+	assert.True(routed > 0)
+
+	assert.True(errors.Is(kv.DeleteShard(ctx, "shard1"), core.ErrShardNotEmpty))
+	assert.Error(kv.DeleteShard(ctx, "shard9"))
+
+	// aborting a migration restores the layout, shards cannot join it meanwhile
+	assert.NoError(kv.BeginMigration([]core.Shard{{Name: "shard3", Backend: memory.New()}}))
+	assert.Equal(core.ErrMigrationInProgress, kv.AddShard(ctx, "shard4", memory.New()))
+	assert.NoError(kv.AbortMigration())
+	assert.Equal([]string{"shard0", "shard1"}, kv.StatusMigration().From)
+
+	single := core.New([]core.Shard{{Name: "shard0", Backend: memory.New()}})
+	assert.Error(single.DeleteShard(ctx, "shard0"), "the last shard stays")
+}
+
+func TestAddShardToStoreWithData(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	shard0 := core.Shard{Name: "shard0", Backend: memory.New()}
+	kv := core.New([]core.Shard{shard0})
+	var cells []models.Cell
+	for i := 0; i < 20; i++ {
+		cell := newBusiness(1, "companies", "uber.com", "Uber")
+		assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+		cells = append(cells, cell)
+	}
+
+	// the rows the new shard would take over could no longer be found, the layout stays
+	assert.True(errors.Is(kv.AddShard(ctx, "shard1", memory.New()), core.ErrShardNotEmpty))
+	assert.Equal([]string{"shard0"}, kv.StatusMigration().From)
+
+	// a migration copies them over
+	assert.NoError(kv.BeginMigration([]core.Shard{shard0, {Name: "shard1", Backend: memory.New()}}))
+	assert.NoError(core.NewCopier(kv, core.NewMemoryCheckpointer()).Run(ctx))
+	assert.NoError(kv.CompleteMigration())
+	for _, cell := range cells {
+		_, found, err := kv.GetCellLatest(ctx, cell.RowKey, "companies")
+		assert.NoError(err)
+		assert.True(found)
+	}
+	matches, found, err := kv.GetCellsByFieldLatest(ctx, "companies", "domain", "uber.com", "=")
+	assert.NoError(err)
+	assert.True(found)
+	assert.Len(matches, 20, "shard0 keeps the rows that moved to shard1, they are read once")
+}
+
+func TestDeleteMiddleShard(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	shards := []core.Shard{{Name: "a", Backend: memory.New()}, {Name: "b", Backend: memory.New()}, {Name: "c", Backend: memory.New()}}
+	kv := core.New(shards)
+	var cells []models.Cell
+	for len(cells) < 200 {
+		cell := newBusiness(1, "companies", "uber.com", "Uber")
+		if kv.ShardFor(cell.RowKey) == "b" {
+			continue
+		}
+		assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+		cells = append(cells, cell)
+	}
+	readAll := func() {
+		for _, cell := range cells {
+			_, found, err := kv.GetCellLatest(ctx, cell.RowKey, "companies")
+			assert.NoError(err)
+			assert.True(found)
+		}
+	}
+
+	// b is empty, but removing it from the middle of the jump hash would move rows of c
+	assert.Error(kv.DeleteShard(ctx, "b"))
+	readAll()
+
+	assert.NoError(kv.BeginMigration([]core.Shard{shards[0], shards[2]}))
+	assert.NoError(core.NewCopier(kv, core.NewMemoryCheckpointer()).Run(ctx))
+	assert.NoError(kv.CompleteMigration())
+	assert.Equal([]string{"a", "c"}, kv.StatusMigration().From)
+	readAll()
+
+	// without cells anywhere, no row can move
+	empty := core.New([]core.Shard{{Name: "a", Backend: memory.New()}, {Name: "b", Backend: memory.New()}, {Name: "c", Backend: memory.New()}})
+	assert.NoError(empty.DeleteShard(ctx, "b"))
+	assert.Equal([]string{"a", "c"}, empty.StatusMigration().From)
+
+	// rendezvous only moves the rows of the removed shard, whatever its place
+	chooser, err := core.NewChooser(core.ChooserConfig{Kind: "rendezvous"})
+	assert.NoError(err)
+	shards = []core.Shard{{Name: "a", Backend: memory.New()}, {Name: "b", Backend: memory.New()}, {Name: "c", Backend: memory.New()}}
+	kv, err = core.NewWithChooser(shards, chooser)
+	assert.NoError(err)
+	cells = nil
+	for len(cells) < 200 {
+		cell := newBusiness(1, "companies", "uber.com", "Uber")
+		if kv.ShardFor(cell.RowKey) == "b" {
+			continue
+		}
+		assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+		cells = append(cells, cell)
+	}
+	assert.NoError(kv.DeleteShard(ctx, "b"))
+	readAll()
+}
+
+func TestDeleteShardDuringMigration(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	shards := []core.Shard{{Name: "shard0", Backend: memory.New()}, {Name: "shard1", Backend: memory.New()}}
+	kv := core.New(shards)
+	var cells []models.Cell
+	for i := 0; i < 50; i++ {
+		cell := newBusiness(1, "companies", "uber.com", "Uber")
+		assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+		cells = append(cells, cell)
+	}
+	found := func() (count int) {
+		for _, cell := range cells {
+			_, ok, err := kv.GetCellLatest(ctx, cell.RowKey, "companies")
+			assert.NoError(err)
+			if ok {
+				count++
+			}
+		}
+		return count
+	}
+
+	// shard1 is kept, shard0 is being drained
+	assert.NoError(kv.BeginMigration([]core.Shard{shards[1], {Name: "shard2", Backend: memory.New()}}))
+	assert.Equal(core.ErrMigrationInProgress, kv.DeleteShard(ctx, "shard1"))
+
+	// shard0 may go before its rows were copied, they are no longer read
+	assert.NoError(kv.DeleteShard(ctx, "shard0"))
+	assert.Equal([]string{"shard1"}, kv.StatusMigration().From)
+	assert.True(found() < len(cells))
+	matches, _, err := kv.GetCellsByColumnLatest(ctx, "companies")
+	assert.NoError(err)
+	assert.Len(matches, found())
+	_, err = kv.AppendCell(ctx, cells[0].RowKey, "companies", cells[0].Body)
+	assert.NoError(err)
+
+	// aborting brings it back
+	assert.NoError(kv.AbortMigration())
+	assert.Equal([]string{"shard0", "shard1"}, kv.StatusMigration().From)
+	assert.Equal(len(cells), found())
+
+	// once copied, it can go for good
+	assert.NoError(kv.BeginMigration([]core.Shard{shards[1], {Name: "shard2", Backend: memory.New()}}))
+	assert.NoError(core.NewCopier(kv, core.NewMemoryCheckpointer()).Run(ctx))
+	assert.NoError(kv.DeleteShard(ctx, "shard0"))
+	assert.Equal(len(cells), found())
+	assert.NoError(kv.CompleteMigration())
+	assert.Equal([]string{"shard1", "shard2"}, kv.StatusMigration().From)
+	assert.Equal(len(cells), found())
+}
+
+func TestPutCellIf(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	kv := newMemoryStore()
+	defer kv.Destroy(ctx)
+
+	first := newBusiness(1, "companies", "uber.com", "Uber")
+	assert.NoError(kv.PutCellIf(ctx, first, core.NoRefKey))
+
+	// of the writers expecting the same version, exactly one wins
+	var (
+		wg  sync.WaitGroup
+		won int32
+	)
+	for i := int64(0); i < 10; i++ {
+		wg.Add(1)
+		go func(refKey int64) {
+			defer wg.Done()
+			cell := newBusiness(refKey, "companies", "uber.com", "Uber")
+			cell.RowKey = first.RowKey
+			err := kv.PutCellIf(ctx, cell, 1)
+			if err == nil {
+				atomic.AddInt32(&won, 1)
+				return
+			}
+			assert.True(errors.Is(err, core.ErrPreconditionFailed))
+		}(i + 2)
+	}
+	wg.Wait()
+	assert.Equal(int32(1), won)
+
+	// during a migration, the latest version may still only be on the old layout
+	assert.NoError(kv.BeginMigration([]core.Shard{{Name: "shard3", Backend: memory.New()}}))
+	latest, _, err := kv.GetCellLatest(ctx, first.RowKey, "companies")
+	assert.NoError(err)
+	next := newBusiness(latest.RefKey+1, "companies", "uber.com", "Uber")
+	next.RowKey = first.RowKey
+	assert.True(errors.Is(kv.PutCellIf(ctx, next, core.NoRefKey), core.ErrPreconditionFailed))
+	assert.True(errors.Is(kv.PutCellIf(ctx, next, 1), core.ErrPreconditionFailed))
+	assert.NoError(kv.PutCellIf(ctx, next, latest.RefKey))
+	assert.Equal(int64(1), kv.StatusMigration().Writes)
+
+	again := newBusiness(next.RefKey+1, "companies", "uber.com", "Uber")
+	again.RowKey = first.RowKey
+	assert.True(errors.Is(kv.PutCellIf(ctx, again, latest.RefKey), core.ErrPreconditionFailed))
+	assert.NoError(kv.PutCellIf(ctx, again, next.RefKey))
+
+	// an older version matching the precondition must not become the latest
+	older := newBusiness(1, "companies", "ubereats.com", "Uber Eats")
+	older.RowKey = first.RowKey
+	assert.True(errors.Is(kv.PutCellIf(ctx, older, again.RefKey), core.ErrPreconditionFailed))
+	latest, _, err = kv.GetCellLatest(ctx, first.RowKey, "companies")
+	assert.NoError(err)
+	assert.Equal(again.RefKey, latest.RefKey)
+}
+
+func TestAppendCell(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	kv := newMemoryStore()
+	defer kv.Destroy(ctx)
+
+	rowKey := utils.NewUUID().Bytes()
+	cell, err := kv.AppendCell(ctx, rowKey, "companies", []byte(`{"name":"Uber"}`))
+	assert.NoError(err)
+	assert.Equal(int64(1), cell.RefKey)
+
+	// versions written by callers choosing their own ref keys are followed
+	assert.NoError(kv.PutCell(ctx, rowKey, "companies", 100, models.NewCell(rowKey, "companies", 100, []byte(`{"name":"Uber Eats"}`))))
+
+	refKeys := make(chan int64, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cell, err := kv.AppendCell(ctx, rowKey, "companies", []byte(`{"name":"Uber Freight"}`))
+			assert.NoError(err)
+			refKeys <- cell.RefKey
+		}()
+	}
+	wg.Wait()
+	close(refKeys)
+	seen := make(map[int64]bool)
+	for refKey := range refKeys {
+		assert.True(refKey > 100 && refKey <= 110)
+		seen[refKey] = true
+	}
+	assert.Len(seen, 10, "every append gets its own ref key")
+
+	latest, found, err := kv.GetCellLatest(ctx, rowKey, "companies")
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(int64(110), latest.RefKey)
+
+	// during a migration the versions still on the old layout count too
+	assert.NoError(kv.BeginMigration([]core.Shard{{Name: "shard3", Backend: memory.New()}}))
+	cell, err = kv.AppendCell(ctx, rowKey, "companies", []byte(`{"name":"Uber"}`))
+	assert.NoError(err)
+	assert.Equal(int64(111), cell.RefKey)
+	assert.Equal(rowKey, cell.RowKey)
+	assert.Equal([]byte(`{"name":"Uber"}`), cell.Body)
+}
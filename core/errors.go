@@ -0,0 +1,77 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Errors returned by the KVStore and its Storage backends, callers match them with errors.Is.
+// Backends wrap the driver's error so that its message is kept.
+var (
+	// ErrNotUnique is returned by GetCellByUniqueFieldLatest when more than one row holds the value
+	ErrNotUnique = errors.New("field value not unique")
+	// ErrShardUnavailable is returned when a shard cannot be reached or did not answer in time
+	ErrShardUnavailable = errors.New("shard unavailable")
+	// ErrDuplicateCell is returned by PutCells when a cell with the same row key, column name and ref key already exists
+	ErrDuplicateCell = errors.New("duplicate cell for row key, column name and ref key")
+	// ErrConflictingCell is returned by PutCell when a cell with the same row key, column name and ref key
+	// already exists with another body. Writing the same body again succeeds, so that writes can be retried.
+	ErrConflictingCell = errors.New("conflicting cell for row key, column name and ref key")
+	// ErrMigrationInProgress is returned by BeginMigration while another migration is running, and by AddShard
+	// and DeleteShard
+	ErrMigrationInProgress = errors.New("shard migration already in progress")
+	// ErrNoMigration is returned when completing or aborting a migration that was never begun
+	ErrNoMigration = errors.New("no shard migration in progress")
+	// ErrPreconditionFailed is returned by PutCellIf when the latest ref key is not the expected one
+	ErrPreconditionFailed = errors.New("latest ref key does not match the expected one")
+	// ErrShardNotEmpty is returned by DeleteShard for a shard still holding cells, and by AddShard while any
+	// shard holds them
+	ErrShardNotEmpty = errors.New("shard still holds cells")
+)
+
+// ShardErrors collects the failures of individual shards during a cross-shard read, keyed by shard name
+type ShardErrors map[string]error
+
+func (e ShardErrors) Error() string {
+	shards := make([]string, 0, len(e))
+	for shard := range e {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+
+	parts := make([]string, len(shards))
+	for i, shard := range shards {
+		parts[i] = fmt.Sprintf("shard %s: %v", shard, e[shard])
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Unwrap lets errors.Is and errors.As look into the error of every shard
+func (e ShardErrors) Unwrap() []error {
+	errs := make([]error, 0, len(e))
+	for _, err := range e {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// mergeShardErrors combines the ShardErrors of two cross-shard reads, either of which may be nil
+func mergeShardErrors(a, b error) error {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	merged := make(ShardErrors)
+	for _, err := range []error{a, b} {
+		if errs, ok := err.(ShardErrors); ok {
+			for shard, err := range errs {
+				merged[shard] = err
+			}
+		}
+	}
+	return merged
+}
@@ -0,0 +1,213 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	jh "code.jogchat.internal/dgryski-go-shardedkv/choosers/jump"
+	"code.jogchat.internal/go-schemaless/models"
+)
+
+// MigrationStatus describes the shard migration of a KVStore, if any
+type MigrationStatus struct {
+	// Active is set between BeginMigration and CompleteMigration or AbortMigration
+	Active bool
+	// ID is derived from the current and the new layout, so that a migration begun again between the
+	// same layouts, say after a restart, has the same one. The Copier keys its checkpoints by it.
+	ID string
+	// From and To are the shard names of the current and of the new layout
+	From []string
+	To   []string
+	// StartedAt is when BeginMigration was called
+	StartedAt time.Time
+	// Writes counts the cells written to the new layout since the migration began
+	Writes int64
+}
+
+// BeginMigration starts moving the KVStore onto a new set of shards. From now on writes are
+// routed to the new layout, while reads look at the new layout first and fall back to the current one.
+// A shard may be part of both layouts, as long as it keeps the same name and backend.
+func (kv *KVStore) BeginMigration(shards []Shard) error {
+	return kv.beginMigration(shards, func(storages map[string]Storage, buckets []string) (Chooser, error) {
+		chooser := jh.New(hash64)
+		if err := chooser.SetBuckets(buckets); err != nil {
+			return nil, err
+		}
+		return chooser, nil
+	})
+}
+
+// BeginMigrationWithChooser is BeginMigration onto a layout routed by chooser, see NewChooser.
+// The chooser's buckets are set to the shards, in order.
+func (kv *KVStore) BeginMigrationWithChooser(shards []Shard, chooser Chooser) error {
+	return kv.beginMigration(shards, func(storages map[string]Storage, buckets []string) (Chooser, error) {
+		if err := chooser.SetBuckets(buckets); err != nil {
+			return nil, err
+		}
+		return chooser, nil
+	})
+}
+
+// BeginShardMapMigration is BeginMigration onto a layout sharded through m, typically obtained
+// by rebalancing the current ShardMap. Only the logical shards m assigns elsewhere have to be copied.
+func (kv *KVStore) BeginShardMapMigration(shards []Shard, m *ShardMap) error {
+	return kv.beginMigration(shards, func(storages map[string]Storage, buckets []string) (Chooser, error) {
+		return newShardMapChooser(m, storages)
+	})
+}
+
+// beginMigration starts a migration onto shards, routed by the chooser newChooser builds for them
+func (kv *KVStore) beginMigration(shards []Shard, newChooser func(storages map[string]Storage, buckets []string) (Chooser, error)) error {
+	if len(shards) == 0 {
+		return errors.New("migration needs at least one shard")
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if kv.migration != nil {
+		return ErrMigrationInProgress
+	}
+
+	storages := make(map[string]Storage)
+	buckets := make([]string, 0, len(shards))
+	for _, shard := range shards {
+		if _, ok := storages[shard.Name]; ok {
+			return fmt.Errorf("shard %s listed twice", shard.Name)
+		}
+		// cross-shard reads visit both layouts by shard name
+		if storage, ok := kv.storages[shard.Name]; ok {
+			if primaryOf(storage) != shard.Backend {
+				return fmt.Errorf("shard %s already names another backend", shard.Name)
+			}
+			storages[shard.Name] = storage
+		} else {
+			storages[shard.Name] = backendOf(shard)
+		}
+		buckets = append(buckets, shard.Name)
+	}
+
+	chooser, err := newChooser(storages, buckets)
+	if err != nil {
+		return err
+	}
+
+	kv.migration = chooser
+	kv.mstorages = storages
+	kv.migrationID = migrationID(kv.continuum, chooser)
+	kv.migrationStarted = time.Now()
+	kv.migrationWrites = 0
+	return nil
+}
+
+// StatusMigration reports the shard migration in progress, if any
+func (kv *KVStore) StatusMigration() MigrationStatus {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	if kv.migration == nil {
+		return MigrationStatus{From: shardNames(kv.storages)}
+	}
+	return MigrationStatus{
+		Active:    true,
+		ID:        kv.migrationID,
+		From:      shardNames(kv.storages),
+		To:        shardNames(kv.mstorages),
+		StartedAt: kv.migrationStarted,
+		Writes:    atomic.LoadInt64(&kv.migrationWrites),
+	}
+}
+
+// CompleteMigration atomically makes the new layout the only one. Cells that were only ever
+// written to the old layout are no longer visible, so they must have been copied over first.
+// Shards that are not part of the new layout are left untouched for the caller to Destroy, and
+// shards kept in it still hold the rows that moved off them, which reads leave out.
+func (kv *KVStore) CompleteMigration() error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if kv.migration == nil {
+		return ErrNoMigration
+	}
+
+	kv.continuum, kv.storages = kv.migration, kv.mstorages
+	kv.migration, kv.mstorages, kv.retired = nil, nil, nil
+	return nil
+}
+
+// AbortMigration goes back to the current layout alone, including the shards DeleteShard took out
+// of it meanwhile. Cells written since BeginMigration stay on the new layout's shards and are no
+// longer visible, see MigrationStatus.Writes.
+func (kv *KVStore) AbortMigration() error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if kv.migration == nil {
+		return ErrNoMigration
+	}
+
+	for shard, storage := range kv.retired {
+		kv.storages[shard] = storage
+	}
+	kv.migration, kv.mstorages, kv.retired = nil, nil, nil
+	return nil
+}
+
+// readStorages returns the storages a cross-shard read must visit, those of both layouts
+// during a migration. Callers must hold kv.mu.
+func (kv *KVStore) readStorages() map[string]Storage {
+	if kv.migration == nil {
+		return kv.storages
+	}
+	storages := make(map[string]Storage, len(kv.storages)+len(kv.mstorages))
+	for shard, storage := range kv.storages {
+		storages[shard] = storage
+	}
+	for shard, storage := range kv.mstorages {
+		storages[shard] = storage
+	}
+	return storages
+}
+
+// latestPerCell keeps, in order of first appearance, the version with the highest ref key
+// of each row key and column, as a cell may be found in both layouts during a migration
+func latestPerCell(cells []models.Cell) []models.Cell {
+	type cellKey struct {
+		rowKey     string
+		columnName string
+	}
+
+	positions := make(map[cellKey]int)
+	var latest []models.Cell
+	for _, cell := range cells {
+		key := cellKey{rowKey: string(cell.RowKey), columnName: cell.ColumnName}
+		i, ok := positions[key]
+		if !ok {
+			positions[key] = len(latest)
+			latest = append(latest, cell)
+			continue
+		}
+		if cell.RefKey > latest[i].RefKey {
+			latest[i] = cell
+		}
+	}
+	return latest
+}
+
+// migrationID returns the ID of the migration from the layout routed by from to the one routed by to
+func migrationID(from, to Chooser) string {
+	return strconv.FormatUint(hash64([]byte(describe(from)+" -> "+describe(to))), 36)
+}
+
+func shardNames(storages map[string]Storage) []string {
+	names := make([]string, 0, len(storages))
+	for name := range storages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,147 @@
+package core_test
+
+import (
+	"context"
+	"testing"
+
+	"code.jogchat.internal/go-schemaless/core"
+	"code.jogchat.internal/go-schemaless/models"
+	"code.jogchat.internal/go-schemaless/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigration(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	old := []core.Shard{{Name: "shard0", Backend: memory.New()}, {Name: "shard1", Backend: memory.New()}}
+	kv := core.New(old)
+
+	status := kv.StatusMigration()
+	assert.False(status.Active)
+	assert.Equal([]string{"shard0", "shard1"}, status.From)
+	assert.Equal(core.ErrNoMigration, kv.CompleteMigration())
+	assert.Equal(core.ErrNoMigration, kv.AbortMigration())
+
+	var before []models.Cell
+	for i := 0; i < 10; i++ {
+		cell := newBusiness(1, "companies", "uber.com", "Uber")
+		assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+		before = append(before, cell)
+	}
+
+	// shard1 carries over, shard2 is new
+	next := []core.Shard{old[1], {Name: "shard2", Backend: memory.New()}}
+	assert.Error(kv.BeginMigration([]core.Shard{{Name: "shard0", Backend: memory.New()}}), "shard0 names another backend")
+	assert.NoError(kv.BeginMigration(next))
+	assert.Equal(core.ErrMigrationInProgress, kv.BeginMigration(next))
+
+	// a newer version of a cell written before the migration lands on the new layout
+	updated := newBusiness(2, "companies", "uber.com", "Uber")
+	updated.RowKey = before[0].RowKey
+	assert.NoError(kv.PutCell(ctx, updated.RowKey, updated.ColumnName, updated.RefKey, updated))
+	_, err := kv.PutCells(ctx, []models.Cell{newBusiness(1, "companies", "lyft.com", "Lyft")})
+	assert.NoError(err)
+
+	status = kv.StatusMigration()
+	assert.True(status.Active)
+	assert.Equal([]string{"shard1", "shard2"}, status.To)
+	assert.Equal(int64(2), status.Writes)
+	assert.False(status.StartedAt.IsZero())
+
+	// reads fall back to the old layout
+	for _, cell := range before[1:] {
+		latest, found, err := kv.GetCellLatest(ctx, cell.RowKey, "companies")
+		assert.NoError(err)
+		assert.True(found)
+		assert.Equal(cell.Body, latest.Body)
+	}
+	latest, found, err := kv.GetCellLatest(ctx, updated.RowKey, "companies")
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(int64(2), latest.RefKey)
+
+	// cross-shard reads see both layouts, each cell once
+	cells, found, err := kv.GetCellsByColumnLatest(ctx, "companies")
+	assert.NoError(err)
+	assert.True(found)
+	assert.Len(cells, 11)
+	for _, cell := range cells {
+		if string(cell.RowKey) == string(updated.RowKey) {
+			assert.Equal(int64(2), cell.RefKey)
+		}
+	}
+	cell, found, err := kv.GetCellByUniqueFieldLatest(ctx, "companies", "domain", "lyft.com")
+	assert.NoError(err)
+	assert.True(found)
+	assert.Contains(string(cell.Body), "Lyft")
+
+	assert.NoError(kv.AbortMigration())
+	assert.False(kv.StatusMigration().Active)
+	for i := 0; i < 10; i++ {
+		cell := newBusiness(1, "companies", "grab.com", "Grab")
+		assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+		_, found, err := next[1].Backend.GetCellLatest(ctx, cell.RowKey, "companies")
+		assert.NoError(err)
+		assert.False(found, "writes no longer reach the aborted layout")
+	}
+
+	assert.NoError(kv.BeginMigration(next))
+	assert.NoError(kv.CompleteMigration())
+	status = kv.StatusMigration()
+	assert.False(status.Active)
+	assert.Equal([]string{"shard1", "shard2"}, status.From)
+
+	cell = newBusiness(1, "companies", "grab.com", "Grab")
+	assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+	latest, found, err = kv.GetCellLatest(ctx, cell.RowKey, "companies")
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(cell.Body, latest.Body)
+	_, found, err = old[0].Backend.GetCellLatest(ctx, cell.RowKey, "companies")
+	assert.NoError(err)
+	assert.False(found, "writes no longer reach retired shards")
+}
+
+func TestMigrationLeftovers(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	shards := []core.Shard{{Name: "shard0", Backend: memory.New()}, {Name: "shard1", Backend: memory.New()}}
+	kv := core.New(shards[:1])
+	// a row the migration moves to shard1
+	grown := core.New(shards)
+	cell := newBusiness(1, "companies", "old.com", "Old")
+	for grown.ShardFor(cell.RowKey) != "shard1" {
+		cell = newBusiness(1, "companies", "old.com", "Old")
+	}
+	assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+
+	assert.NoError(kv.BeginMigration(shards))
+	assert.NoError(core.NewCopier(kv, core.NewMemoryCheckpointer()).Run(ctx))
+	assert.NoError(kv.CompleteMigration())
+	updated := newBusiness(2, "companies", "new.com", "New")
+	updated.RowKey = cell.RowKey
+	assert.NoError(kv.PutCell(ctx, updated.RowKey, updated.ColumnName, updated.RefKey, updated))
+
+	// shard0 still holds the first version, which is no longer read from there
+	_, found, err := shards[0].Backend.GetCellLatest(ctx, cell.RowKey, "companies")
+	assert.NoError(err)
+	assert.True(found)
+	cells, found, err := kv.GetCellsByColumnLatest(ctx, "companies")
+	assert.NoError(err)
+	assert.True(found)
+	if assert.Len(cells, 1) {
+		assert.Equal(updated.Body, cells[0].Body)
+	}
+	exist, err := kv.CheckValueExist(ctx, "companies", "domain", "old.com")
+	assert.NoError(err)
+	assert.False(exist)
+	_, found, err = kv.GetCellByUniqueFieldLatest(ctx, "companies", "domain", "old.com")
+	assert.NoError(err)
+	assert.False(found)
+	latest, found, err := kv.GetCellByUniqueFieldLatest(ctx, "companies", "domain", "new.com")
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(updated.Body, latest.Body)
+}
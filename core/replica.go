@@ -0,0 +1,275 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"code.jogchat.internal/go-schemaless/models"
+)
+
+// ReadPolicy decides which member of a ReplicaSet serves a read
+type ReadPolicy int
+
+const (
+	// PrimaryOnly reads from the primary, which always has the latest writes
+	PrimaryOnly ReadPolicy = iota
+	// ReplicaPreferred spreads reads over the replicas, falling back to the primary when none answers
+	ReplicaPreferred
+	// Nearest reads from the member that has been answering the fastest, primary included
+	Nearest
+)
+
+// ParseReadPolicy returns the ReadPolicy named "primary_only", "replica_preferred" or "nearest"
+func ParseReadPolicy(name string) (ReadPolicy, error) {
+	switch name {
+	case "primary_only":
+		return PrimaryOnly, nil
+	case "replica_preferred":
+		return ReplicaPreferred, nil
+	case "nearest":
+		return Nearest, nil
+	default:
+		return PrimaryOnly, fmt.Errorf("unknown read policy %s", name)
+	}
+}
+
+type readPolicyKey struct{}
+
+// WithReadPolicy overrides the read policy of every ReplicaSet for the reads made with the returned context.
+// Reads that must see their own writes, or whatever the primary has, should use PrimaryOnly.
+func WithReadPolicy(ctx context.Context, policy ReadPolicy) context.Context {
+	return context.WithValue(ctx, readPolicyKey{}, policy)
+}
+
+// ReplicaSet is a shard made of a primary, which takes every write, and replicas it replicates to.
+// Reads are routed by ReadPolicy and move on to the next member when one is unavailable.
+// Replicas may lag behind, a read served by one may miss the latest writes.
+type ReplicaSet struct {
+	// members holds the primary first, then the replicas
+	members []Storage
+	policy  ReadPolicy
+	// next rotates reads over the replicas, latencies holds the moving average of each member's
+	// answer time in nanoseconds, both are updated atomically
+	next      uint32
+	latencies []int64
+}
+
+// NewReplicaSet returns a ReplicaSet reading from primary only until a policy is set
+func NewReplicaSet(primary Storage, replicas ...Storage) *ReplicaSet {
+	members := append([]Storage{primary}, replicas...)
+	return &ReplicaSet{
+		members:   members,
+		latencies: make([]int64, len(members)),
+	}
+}
+
+// WithReadPolicy sets the policy of the reads whose context carries none
+func (r *ReplicaSet) WithReadPolicy(policy ReadPolicy) *ReplicaSet {
+	r.policy = policy
+	return r
+}
+
+// Primary returns the member taking the writes
+func (r *ReplicaSet) Primary() Storage {
+	return r.members[0]
+}
+
+// order returns the members to try for a read under the policy of ctx, by index
+func (r *ReplicaSet) order(ctx context.Context) []int {
+	policy := r.policy
+	if p, ok := ctx.Value(readPolicyKey{}).(ReadPolicy); ok {
+		policy = p
+	}
+
+	switch {
+	case policy == ReplicaPreferred && len(r.members) > 1:
+		replicas := len(r.members) - 1
+		first := int(atomic.AddUint32(&r.next, 1) % uint32(replicas))
+		order := make([]int, 0, len(r.members))
+		for i := 0; i < replicas; i++ {
+			order = append(order, 1+(first+i)%replicas)
+		}
+		return append(order, 0)
+	case policy == Nearest:
+		order := make([]int, len(r.members))
+		latencies := make([]int64, len(r.members))
+		for i := range order {
+			order[i] = i
+			latencies[i] = atomic.LoadInt64(&r.latencies[i])
+		}
+		// members not measured yet come first, so that they get measured
+		sort.SliceStable(order, func(i, j int) bool { return latencies[order[i]] < latencies[order[j]] })
+		return order
+	default:
+		return []int{0}
+	}
+}
+
+// read runs fn against the members picked for ctx until one answers or fails for another reason than being unavailable
+func (r *ReplicaSet) read(ctx context.Context, fn func(storage Storage) error) error {
+	var err error
+	for _, i := range r.order(ctx) {
+		start := time.Now()
+		err = fn(r.members[i])
+		r.observe(i, time.Since(start))
+		if err == nil || !errors.Is(err, ErrShardUnavailable) || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// observe folds the answer time of member i into its moving average
+func (r *ReplicaSet) observe(i int, elapsed time.Duration) {
+	old := atomic.LoadInt64(&r.latencies[i])
+	if old == 0 {
+		atomic.StoreInt64(&r.latencies[i], int64(elapsed)+1)
+		return
+	}
+	atomic.StoreInt64(&r.latencies[i], old+(int64(elapsed)-old)/8)
+}
+
+func (r *ReplicaSet) GetCell(ctx context.Context, rowKey []byte, columnKey string, refKey int64) (cell models.Cell, found bool, err error) {
+	err = r.read(ctx, func(storage Storage) error {
+		cell, found, err = storage.GetCell(ctx, rowKey, columnKey, refKey)
+		return err
+	})
+	return cell, found, err
+}
+
+func (r *ReplicaSet) GetCellLatest(ctx context.Context, rowKey []byte, columnKey string) (cell models.Cell, found bool, err error) {
+	err = r.read(ctx, func(storage Storage) error {
+		cell, found, err = storage.GetCellLatest(ctx, rowKey, columnKey)
+		return err
+	})
+	return cell, found, err
+}
+
+func (r *ReplicaSet) GetCellVersions(ctx context.Context, rowKey []byte, columnKey string, opts VersionOptions) (cells []models.Cell, found bool, err error) {
+	err = r.read(ctx, func(storage Storage) error {
+		cells, found, err = storage.GetCellVersions(ctx, rowKey, columnKey, opts)
+		return err
+	})
+	return cells, found, err
+}
+
+func (r *ReplicaSet) GetRowLatest(ctx context.Context, rowKey []byte, columns ...string) (cells map[string]models.Cell, found bool, err error) {
+	err = r.read(ctx, func(storage Storage) error {
+		cells, found, err = storage.GetRowLatest(ctx, rowKey, columns...)
+		return err
+	})
+	return cells, found, err
+}
+
+func (r *ReplicaSet) MultiGetCellLatest(ctx context.Context, rowKeys [][]byte, columnKey string) (cells map[string]models.Cell, found bool, err error) {
+	err = r.read(ctx, func(storage Storage) error {
+		cells, found, err = storage.MultiGetCellLatest(ctx, rowKeys, columnKey)
+		return err
+	})
+	return cells, found, err
+}
+
+func (r *ReplicaSet) GetCellsByColumnLatest(ctx context.Context, columnKey string) (cells []models.Cell, found bool, err error) {
+	err = r.read(ctx, func(storage Storage) error {
+		cells, found, err = storage.GetCellsByColumnLatest(ctx, columnKey)
+		return err
+	})
+	return cells, found, err
+}
+
+func (r *ReplicaSet) GetCellsByFieldLatest(ctx context.Context, columnKey string, field string, value interface{}, operator string) (cells []models.Cell, found bool, err error) {
+	err = r.read(ctx, func(storage Storage) error {
+		cells, found, err = storage.GetCellsByFieldLatest(ctx, columnKey, field, value, operator)
+		return err
+	})
+	return cells, found, err
+}
+
+func (r *ReplicaSet) GetCellByUniqueFieldLatest(ctx context.Context, columnKey string, field string, value interface{}) (cell models.Cell, found bool, err error) {
+	err = r.read(ctx, func(storage Storage) error {
+		cell, found, err = storage.GetCellByUniqueFieldLatest(ctx, columnKey, field, value)
+		return err
+	})
+	return cell, found, err
+}
+
+func (r *ReplicaSet) ScanCells(ctx context.Context, after int64, limit int) (cells []models.Cell, found bool, err error) {
+	err = r.read(ctx, func(storage Storage) error {
+		cells, found, err = storage.ScanCells(ctx, after, limit)
+		return err
+	})
+	return cells, found, err
+}
+
+func (r *ReplicaSet) CountCellsAfter(ctx context.Context, after int64) (count int64, err error) {
+	err = r.read(ctx, func(storage Storage) error {
+		count, err = storage.CountCellsAfter(ctx, after)
+		return err
+	})
+	return count, err
+}
+
+// LastAddedAt is served by the primary, replicas may not have all of its cells yet
+func (r *ReplicaSet) LastAddedAt(ctx context.Context, createdBefore time.Time) (int64, error) {
+	return r.Primary().LastAddedAt(ctx, createdBefore)
+}
+
+// LoadCheckpoint is served by the primary, which takes the checkpoints
+func (r *ReplicaSet) LoadCheckpoint(ctx context.Context, consumer string) (int64, error) {
+	return r.Primary().LoadCheckpoint(ctx, consumer)
+}
+
+func (r *ReplicaSet) SaveCheckpoint(ctx context.Context, consumer string, addedAt int64) error {
+	return r.Primary().SaveCheckpoint(ctx, consumer, addedAt)
+}
+
+func (r *ReplicaSet) CheckValueExist(ctx context.Context, columnKey string, field string, value interface{}) (found bool, err error) {
+	err = r.read(ctx, func(storage Storage) error {
+		found, err = storage.CheckValueExist(ctx, columnKey, field, value)
+		return err
+	})
+	return found, err
+}
+
+func (r *ReplicaSet) PutCell(ctx context.Context, rowKey []byte, columnKey string, refKey int64, cell models.Cell, ignoreFields ...string) error {
+	return r.Primary().PutCell(ctx, rowKey, columnKey, refKey, cell, ignoreFields...)
+}
+
+func (r *ReplicaSet) PutCellIf(ctx context.Context, cell models.Cell, expectedLatestRefKey int64, ignoreFields ...string) error {
+	return r.Primary().PutCellIf(ctx, cell, expectedLatestRefKey, ignoreFields...)
+}
+
+func (r *ReplicaSet) PutCells(ctx context.Context, cells []models.Cell, ignoreFields ...string) error {
+	return r.Primary().PutCells(ctx, cells, ignoreFields...)
+}
+
+// Destroy releases every member, returning the first error
+func (r *ReplicaSet) Destroy(ctx context.Context) error {
+	var first error
+	for _, member := range r.members {
+		if err := member.Destroy(ctx); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// backendOf returns the storage of shard, wrapping its backend in a ReplicaSet if it has replicas
+func backendOf(shard Shard) Storage {
+	if len(shard.Replicas) == 0 {
+		return shard.Backend
+	}
+	return NewReplicaSet(shard.Backend, shard.Replicas...).WithReadPolicy(shard.ReadPolicy)
+}
+
+// primaryOf returns the storage taking the writes of storage
+func primaryOf(storage Storage) Storage {
+	if replicas, ok := storage.(*ReplicaSet); ok {
+		return replicas.Primary()
+	}
+	return storage
+}
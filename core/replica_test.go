@@ -0,0 +1,100 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"code.jogchat.internal/go-schemaless/core"
+	"code.jogchat.internal/go-schemaless/models"
+	"code.jogchat.internal/go-schemaless/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingStorage counts the point reads it serves, taking delay to answer each
+type countingStorage struct {
+	*memory.Storage
+	reads *int64
+	delay time.Duration
+	down  bool
+}
+
+func newCountingStorage(delay time.Duration) countingStorage {
+	return countingStorage{Storage: memory.New(), reads: new(int64), delay: delay}
+}
+
+func (s countingStorage) GetCellLatest(ctx context.Context, rowKey []byte, columnKey string) (models.Cell, bool, error) {
+	atomic.AddInt64(s.reads, 1)
+	time.Sleep(s.delay)
+	if s.down {
+		return models.Cell{}, false, core.ErrShardUnavailable
+	}
+	return s.Storage.GetCellLatest(ctx, rowKey, columnKey)
+}
+
+func TestReplicaSet(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	primary, replica := newCountingStorage(0), newCountingStorage(0)
+	kv := core.New([]core.Shard{{Name: "shard0", Backend: primary, Replicas: []core.Storage{replica}, ReadPolicy: core.ReplicaPreferred}})
+
+	// writes stay on the primary, nothing replicates them in this test
+	cell := newBusiness(1, "companies", "uber.com", "Uber")
+	assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+	_, found, err := replica.Storage.GetCellLatest(ctx, cell.RowKey, "companies")
+	assert.NoError(err)
+	assert.False(found)
+
+	_, found, err = kv.GetCellLatest(ctx, cell.RowKey, "companies")
+	assert.NoError(err)
+	assert.False(found, "read from the replica")
+	assert.Equal(int64(1), atomic.LoadInt64(replica.reads))
+
+	_, found, err = kv.GetCellLatest(core.WithReadPolicy(ctx, core.PrimaryOnly), cell.RowKey, "companies")
+	assert.NoError(err)
+	assert.True(found, "the context overrides the shard's policy")
+	assert.Equal(int64(1), atomic.LoadInt64(primary.reads))
+
+	// an unavailable replica falls back to the primary
+	down := newCountingStorage(0)
+	down.down = true
+	set := core.NewReplicaSet(primary, down).WithReadPolicy(core.ReplicaPreferred)
+	_, found, err = set.GetCellLatest(ctx, cell.RowKey, "companies")
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(int64(1), atomic.LoadInt64(down.reads))
+
+	down.Storage = primary.Storage
+	_, _, err = core.NewReplicaSet(down).WithReadPolicy(core.ReplicaPreferred).GetCellLatest(ctx, cell.RowKey, "companies")
+	assert.True(errors.Is(err, core.ErrShardUnavailable), "no replica left to fall back to")
+}
+
+func TestReplicaSetNearest(t *testing.T) {
+	assert := assert.New(t)
+	ctx := core.WithReadPolicy(context.TODO(), core.Nearest)
+
+	slow, fast := newCountingStorage(5*time.Millisecond), newCountingStorage(0)
+	set := core.NewReplicaSet(slow, fast)
+	for i := 0; i < 20; i++ {
+		_, _, err := set.GetCellLatest(ctx, []byte("row"), "companies")
+		assert.NoError(err)
+	}
+	// each is measured once, the fast one serves the rest
+	assert.Equal(int64(1), atomic.LoadInt64(slow.reads))
+	assert.Equal(int64(19), atomic.LoadInt64(fast.reads))
+}
+
+func TestParseReadPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	for name, policy := range map[string]core.ReadPolicy{"primary_only": core.PrimaryOnly, "replica_preferred": core.ReplicaPreferred, "nearest": core.Nearest} {
+		parsed, err := core.ParseReadPolicy(name)
+		assert.NoError(err)
+		assert.Equal(policy, parsed)
+	}
+	_, err := core.ParseReadPolicy("random")
+	assert.Error(err)
+}
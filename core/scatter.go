@@ -0,0 +1,178 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.jogchat.internal/go-schemaless/models"
+)
+
+// ReadMode decides what a cross-shard read does when some of the shards fail
+type ReadMode int
+
+const (
+	// FailFast aborts the read as soon as one shard fails, cancelling the shards still running
+	FailFast ReadMode = iota
+	// BestEffort waits for every shard and returns what the healthy ones answered, along with ShardErrors
+	BestEffort
+)
+
+type readModeKey struct{}
+
+// WithReadMode overrides the KVStore's read mode for the cross-shard reads made with the returned context
+func WithReadMode(ctx context.Context, mode ReadMode) context.Context {
+	return context.WithValue(ctx, readModeKey{}, mode)
+}
+
+// shardQuery is one shard's part of a cross-shard read
+type shardQuery func(ctx context.Context, shard string, storage Storage) (cells []models.Cell, found bool, err error)
+
+// shardResult is what a single shard answered to a shardQuery
+type shardResult struct {
+	shard string
+	cells []models.Cell
+	found bool
+	err   error
+	// aborted is set when the shard failed only because a fail-fast read cancelled it
+	aborted bool
+}
+
+// WithShardTimeout bounds how long each shard may take to answer a cross-shard read,
+// on top of any deadline already carried by the caller's context. Zero disables it.
+func (kv *KVStore) WithShardTimeout(timeout time.Duration) *KVStore {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.shardTimeout = timeout
+	return kv
+}
+
+// WithReadMode sets how cross-shard reads handle failing shards, FailFast by default.
+// It can be overridden per call with the package level WithReadMode.
+func (kv *KVStore) WithReadMode(mode ReadMode) *KVStore {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.readMode = mode
+	return kv
+}
+
+// readModeOf returns the read mode of ctx, falling back to the KVStore's. Callers must hold kv.mu.
+func (kv *KVStore) readModeOf(ctx context.Context) ReadMode {
+	if mode, ok := ctx.Value(readModeKey{}).(ReadMode); ok {
+		return mode
+	}
+	return kv.readMode
+}
+
+// scatter runs query against every storage concurrently and gathers the answers,
+// ordered by shard name so that merged results do not depend on scheduling.
+// Callers must hold kv.mu.
+func (kv *KVStore) scatter(ctx context.Context, storages map[string]Storage, query shardQuery) []shardResult {
+	shards := make([]string, 0, len(storages))
+	for shard := range storages {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	failFast := kv.readModeOf(ctx) == FailFast
+	var failed int32
+
+	results := make([]shardResult, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		results[i].shard = shard
+		wg.Add(1)
+		go func(result *shardResult, storage Storage) {
+			defer wg.Done()
+			// a panicking backend must not take the whole process down from a goroutine
+			defer func() {
+				if r := recover(); r != nil {
+					result.err = fmt.Errorf("%v", r)
+				}
+				if result.err != nil && failFast {
+					if atomic.CompareAndSwapInt32(&failed, 0, 1) {
+						cancel()
+					} else if ctx.Err() != nil {
+						result.aborted = true
+					}
+				}
+			}()
+
+			shardCtx := ctx
+			if kv.shardTimeout > 0 {
+				var cancel context.CancelFunc
+				shardCtx, cancel = context.WithTimeout(ctx, kv.shardTimeout)
+				defer cancel()
+			}
+			result.cells, result.found, result.err = query(shardCtx, result.shard, storage)
+			if result.err != nil && shardCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+				// the shard ran out of its own time, not the caller's
+				result.err = fmt.Errorf("%w: %v", ErrShardUnavailable, result.err)
+			}
+		}(&results[i], storages[shard])
+	}
+	wg.Wait()
+	return results
+}
+
+// owns reports whether shard is where the current layout, or the new one during a migration,
+// puts rowKey. A shard kept through a migration still holds the rows that moved off it,
+// these must not be read from there, neither while the migration runs nor once it completed.
+// Callers must hold kv.mu.
+func (kv *KVStore) owns(shard string, rowKey []byte) bool {
+	if _, ok := kv.storages[shard]; ok && kv.continuum.Choose(string(rowKey)) == shard {
+		return true
+	}
+	if kv.migration == nil {
+		return false
+	}
+	_, ok := kv.mstorages[shard]
+	return ok && kv.migration.Choose(string(rowKey)) == shard
+}
+
+// gather concatenates the cells of every shard in shard order, leaving out those the shard does
+// not own. During a migration it also keeps a cell found in both layouts once. Failed shards
+// are reported as ShardErrors: with FailFast no cells are returned, with BestEffort the others' are.
+func (kv *KVStore) gather(ctx context.Context, results []shardResult) (cells []models.Cell, found bool, err error) {
+	var errs ShardErrors
+	for _, result := range results {
+		if result.err != nil {
+			if result.aborted {
+				continue
+			}
+			if errs == nil {
+				errs = make(ShardErrors)
+			}
+			errs[result.shard] = result.err
+			continue
+		}
+		if !result.found {
+			continue
+		}
+		for _, cell := range result.cells {
+			if kv.owns(result.shard, cell.RowKey) {
+				cells = append(cells, cell)
+				found = true
+			}
+		}
+	}
+
+	if kv.migration != nil {
+		cells = latestPerCell(cells)
+	}
+
+	if errs == nil {
+		return cells, found, nil
+	}
+	if kv.readModeOf(ctx) == FailFast {
+		return nil, false, errs
+	}
+	return cells, found, errs
+}
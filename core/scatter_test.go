@@ -0,0 +1,181 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"code.jogchat.internal/go-schemaless/core"
+	"code.jogchat.internal/go-schemaless/models"
+	"code.jogchat.internal/go-schemaless/storage/memory"
+	"code.jogchat.internal/go-schemaless/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// stuckStorage never answers index lookups until its context is done
+type stuckStorage struct {
+	*memory.Storage
+}
+
+func (s stuckStorage) GetCellsByFieldLatest(ctx context.Context, columnKey string, field string, value interface{}, operator string) ([]models.Cell, bool, error) {
+	<-ctx.Done()
+	return nil, false, ctx.Err()
+}
+
+func (s stuckStorage) GetCellsByColumnLatest(ctx context.Context, columnKey string) ([]models.Cell, bool, error) {
+	<-ctx.Done()
+	return nil, false, ctx.Err()
+}
+
+// brokenStorage fails every cross-shard read
+type brokenStorage struct {
+	*memory.Storage
+}
+
+var errBroken = errors.New("broken shard")
+
+func (s brokenStorage) GetCellsByColumnLatest(ctx context.Context, columnKey string) ([]models.Cell, bool, error) {
+	return nil, false, errBroken
+}
+
+func (s brokenStorage) MultiGetCellLatest(ctx context.Context, rowKeys [][]byte, columnKey string) (map[string]models.Cell, bool, error) {
+	return nil, false, errBroken
+}
+
+// putDirect writes cell straight to the backend of shard, under a row key the shard owns
+func putDirect(t *testing.T, kv *core.KVStore, shard core.Shard, cell models.Cell) {
+	for kv.ShardFor(cell.RowKey) != shard.Name {
+		cell.RowKey = utils.NewUUID().Bytes()
+	}
+	if err := shard.Backend.PutCell(context.TODO(), cell.RowKey, cell.ColumnName, cell.RefKey, cell); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScatterMergesInShardOrder(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	shards := []core.Shard{{Name: "b", Backend: memory.New()}, {Name: "a", Backend: memory.New()}, {Name: "c", Backend: memory.New()}}
+	kv := core.New(shards)
+	putDirect(t, kv, shards[0], newBusiness(1, "companies", "b.com", "B"))
+	putDirect(t, kv, shards[1], newBusiness(1, "companies", "a.com", "A"))
+	putDirect(t, kv, shards[2], newBusiness(1, "companies", "c.com", "C"))
+
+	for i := 0; i < 10; i++ {
+		cells, found, err := kv.GetCellsByColumnLatest(ctx, "companies")
+		assert.NoError(err)
+		assert.True(found)
+		if assert.Len(cells, 3) {
+			assert.Contains(string(cells[0].Body), "a.com")
+			assert.Contains(string(cells[1].Body), "b.com")
+			assert.Contains(string(cells[2].Body), "c.com")
+		}
+	}
+
+	exist, err := kv.CheckValueExist(ctx, "companies", "domain", "c.com")
+	assert.NoError(err)
+	assert.True(exist)
+}
+
+func TestScatterShardTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	kv := core.New([]core.Shard{
+		{Name: "shard0", Backend: memory.New()},
+		{Name: "stuck", Backend: stuckStorage{memory.New()}},
+	}).WithShardTimeout(20 * time.Millisecond)
+
+	start := time.Now()
+	_, _, err := kv.GetCellsByColumnLatest(context.TODO(), "companies")
+	assert.True(errors.Is(err, core.ErrShardUnavailable), "got %v", err)
+	assert.True(time.Since(start) < time.Second)
+}
+
+func TestUniqueFieldCancelsOutstandingShards(t *testing.T) {
+	assert := assert.New(t)
+
+	shards := []core.Shard{
+		{Name: "shard0", Backend: memory.New()},
+		{Name: "shard1", Backend: memory.New()},
+		{Name: "stuck", Backend: stuckStorage{memory.New()}},
+	}
+	kv := core.New(shards)
+	putDirect(t, kv, shards[0], newBusiness(1, "companies", "uber.com", "Uber"))
+	putDirect(t, kv, shards[1], newBusiness(1, "companies", "uber.com", "Uber"))
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := kv.GetCellByUniqueFieldLatest(context.TODO(), "companies", "domain", "uber.com")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Equal(core.ErrNotUnique, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stuck shard was not cancelled")
+	}
+}
+
+func TestReadModeFailFast(t *testing.T) {
+	assert := assert.New(t)
+
+	kv := core.New([]core.Shard{
+		{Name: "broken", Backend: brokenStorage{memory.New()}},
+		{Name: "stuck", Backend: stuckStorage{memory.New()}},
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		cells, found, err := kv.GetCellsByColumnLatest(context.TODO(), "companies")
+		assert.Nil(cells)
+		assert.False(found)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		// the stuck shard was cancelled on our behalf and is not reported
+		assert.Equal(core.ShardErrors{"broken": errBroken}, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stuck shard was not cancelled")
+	}
+}
+
+func TestReadModeBestEffort(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	shards := []core.Shard{
+		{Name: "shard0", Backend: memory.New()},
+		{Name: "broken", Backend: brokenStorage{memory.New()}},
+	}
+	kv := core.New(shards).WithReadMode(core.BestEffort)
+	putDirect(t, kv, shards[0], newBusiness(1, "companies", "uber.com", "Uber"))
+
+	cells, found, err := kv.GetCellsByColumnLatest(ctx, "companies")
+	assert.True(found)
+	assert.Len(cells, 1)
+	var errs core.ShardErrors
+	if assert.True(errors.As(err, &errs)) {
+		assert.Equal(core.ShardErrors{"broken": errBroken}, errs)
+		assert.Equal("shard broken: broken shard", errs.Error())
+	}
+
+	// the context overrides the store's mode
+	cells, found, err = kv.GetCellsByColumnLatest(core.WithReadMode(ctx, core.FailFast), "companies")
+	assert.Nil(cells)
+	assert.False(found)
+	assert.Equal(core.ShardErrors{"broken": errBroken}, err)
+
+	var rowKeys [][]byte
+	for i := 0; i < 20; i++ {
+		cell := newBusiness(1, "companies", "uber.com", "Uber")
+		assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+		rowKeys = append(rowKeys, cell.RowKey)
+	}
+	latest, found, err := kv.MultiGetCellLatest(ctx, rowKeys, "companies")
+	assert.True(found)
+	assert.True(len(latest) > 0 && len(latest) < len(rowKeys))
+	assert.Equal(core.ShardErrors{"broken": errBroken}, err)
+}
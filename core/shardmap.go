@@ -0,0 +1,199 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+// DefaultLogicalShards is the number of logical shards Uber's Schemaless is typically configured with
+const DefaultLogicalShards = 4096
+
+// ShardMap assigns a fixed number of logical shards to physical shards. Row keys hash onto
+// logical shards, which never changes, so that rebalancing moves whole logical shards
+// instead of reshuffling rows whenever a physical shard is added.
+type ShardMap struct {
+	// Shards holds the physical shard of each logical shard, indexed by logical shard
+	Shards []string `json:"shards"`
+}
+
+// NewShardMap spreads logical shards evenly over shards, each one getting a contiguous range
+func NewShardMap(logical int, shards []string) (*ShardMap, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("shard map needs at least one shard")
+	}
+	if logical < len(shards) {
+		return nil, fmt.Errorf("%d logical shards cannot cover %d shards", logical, len(shards))
+	}
+	if err := checkShardNames(shards); err != nil {
+		return nil, err
+	}
+
+	m := &ShardMap{Shards: make([]string, logical)}
+	for i := range m.Shards {
+		m.Shards[i] = shards[i*len(shards)/logical]
+	}
+	return m, nil
+}
+
+// LoadShardMap reads a shard map saved by Save
+func LoadShardMap(path string) (*ShardMap, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m ShardMap
+	if err := json.Unmarshal(bytes, &m); err != nil {
+		return nil, err
+	}
+	if len(m.Shards) == 0 {
+		return nil, fmt.Errorf("shard map %s is empty", path)
+	}
+	for i, shard := range m.Shards {
+		if shard == "" {
+			return nil, fmt.Errorf("shard map %s leaves logical shard %d unassigned", path, i)
+		}
+	}
+	return &m, nil
+}
+
+// Save writes the shard map to path, replacing it atomically
+func (m *ShardMap) Save(path string) error {
+	bytes, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, bytes)
+}
+
+// Logical returns the logical shard of rowKey
+func (m *ShardMap) Logical(rowKey []byte) int {
+	return int(hash64(rowKey) % uint64(len(m.Shards)))
+}
+
+// Choose returns the physical shard of rowKey
+func (m *ShardMap) Choose(rowKey []byte) string {
+	return m.Shards[m.Logical(rowKey)]
+}
+
+// Physical returns the names of the physical shards the map assigns logical shards to, sorted
+func (m *ShardMap) Physical() []string {
+	seen := make(map[string]bool)
+	var shards []string
+	for _, shard := range m.Shards {
+		if !seen[shard] {
+			seen[shard] = true
+			shards = append(shards, shard)
+		}
+	}
+	sort.Strings(shards)
+	return shards
+}
+
+// Assign returns a copy of the map with logical shard moved to shard
+func (m *ShardMap) Assign(logical int, shard string) (*ShardMap, error) {
+	if logical < 0 || logical >= len(m.Shards) {
+		return nil, fmt.Errorf("no logical shard %d", logical)
+	}
+	if shard == "" {
+		return nil, errors.New("logical shards must be assigned to a named shard")
+	}
+	next := m.clone()
+	next.Shards[logical] = shard
+	return next, nil
+}
+
+// Rebalance returns a copy of the map spreading the logical shards evenly over shards.
+// Logical shards stay where they are as long as their shard is kept and not over its share,
+// so that adding or removing a shard moves as few of them as possible.
+func (m *ShardMap) Rebalance(shards []string) (*ShardMap, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("shard map needs at least one shard")
+	}
+	if len(m.Shards) < len(shards) {
+		return nil, fmt.Errorf("%d logical shards cannot cover %d shards", len(m.Shards), len(shards))
+	}
+	if err := checkShardNames(shards); err != nil {
+		return nil, err
+	}
+
+	sorted := append([]string(nil), shards...)
+	sort.Strings(sorted)
+	share := make(map[string]int, len(sorted))
+	for i, shard := range sorted {
+		share[shard] = len(m.Shards) / len(sorted)
+		if i < len(m.Shards)%len(sorted) {
+			share[shard]++
+		}
+	}
+
+	next := m.clone()
+	var moved []int
+	for logical, shard := range next.Shards {
+		if share[shard] > 0 {
+			share[shard]--
+			continue
+		}
+		moved = append(moved, logical)
+	}
+	for _, shard := range sorted {
+		for ; share[shard] > 0; share[shard]-- {
+			next.Shards[moved[0]] = shard
+			moved = moved[1:]
+		}
+	}
+	return next, nil
+}
+
+func (m *ShardMap) clone() *ShardMap {
+	return &ShardMap{Shards: append([]string(nil), m.Shards...)}
+}
+
+// checkShardNames rejects empty and duplicate shard names
+func checkShardNames(shards []string) error {
+	seen := make(map[string]bool, len(shards))
+	for _, shard := range shards {
+		if shard == "" {
+			return errors.New("shards must be named")
+		}
+		if seen[shard] {
+			return fmt.Errorf("shard %s listed twice", shard)
+		}
+		seen[shard] = true
+	}
+	return nil
+}
+
+// shardMapChooser is the Chooser of a KVStore sharded through a ShardMap
+type shardMapChooser struct {
+	m *ShardMap
+}
+
+// errShardMapBuckets is returned by SetBuckets, a shard map rebalanced in place would be lost on restart
+var errShardMapBuckets = errors.New("a shard map changes through BeginShardMapMigration, then saved over its file")
+
+// SetBuckets refuses to change the shards, AddShard and DeleteShard included: the rebalanced map
+// must be saved once its rows were copied, see BeginShardMapMigration.
+func (c *shardMapChooser) SetBuckets(buckets []string) error {
+	return errShardMapBuckets
+}
+
+func (c *shardMapChooser) Choose(key string) string {
+	return c.m.Choose([]byte(key))
+}
+
+func (c *shardMapChooser) Buckets() []string {
+	return c.m.Physical()
+}
+
+// newShardMapChooser returns a Chooser following m, whose shards must all be among storages
+func newShardMapChooser(m *ShardMap, storages map[string]Storage) (*shardMapChooser, error) {
+	for _, shard := range m.Physical() {
+		if _, ok := storages[shard]; !ok {
+			return nil, fmt.Errorf("shard map assigns logical shards to unknown shard %s", shard)
+		}
+	}
+	return &shardMapChooser{m: m.clone()}, nil
+}
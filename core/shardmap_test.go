@@ -0,0 +1,136 @@
+package core_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.jogchat.internal/go-schemaless/core"
+	"code.jogchat.internal/go-schemaless/models"
+	"code.jogchat.internal/go-schemaless/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+func countShards(m *core.ShardMap) map[string]int {
+	counts := make(map[string]int)
+	for _, shard := range m.Shards {
+		counts[shard]++
+	}
+	return counts
+}
+
+func TestShardMap(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := core.NewShardMap(core.DefaultLogicalShards, nil)
+	assert.Error(err)
+	_, err = core.NewShardMap(1, []string{"shard0", "shard1"})
+	assert.Error(err)
+	_, err = core.NewShardMap(16, []string{"shard0", "shard0"})
+	assert.Error(err)
+
+	m, err := core.NewShardMap(core.DefaultLogicalShards, []string{"shard0", "shard1"})
+	assert.NoError(err)
+	assert.Equal(map[string]int{"shard0": 2048, "shard1": 2048}, countShards(m))
+	assert.Equal([]string{"shard0", "shard1"}, m.Physical())
+
+	// adding a shard moves a third of the logical shards, all of them onto it
+	grown, err := m.Rebalance([]string{"shard0", "shard1", "shard2"})
+	assert.NoError(err)
+	assert.Equal(map[string]int{"shard0": 1366, "shard1": 1365, "shard2": 1365}, countShards(grown))
+	for logical, shard := range grown.Shards {
+		if shard != m.Shards[logical] {
+			assert.Equal("shard2", shard)
+		}
+	}
+	assert.Equal(2048, countShards(m)["shard0"], "rebalancing leaves the original alone")
+
+	// removing one moves only its logical shards
+	shrunk, err := grown.Rebalance([]string{"shard1", "shard2"})
+	assert.NoError(err)
+	assert.Equal(map[string]int{"shard1": 2048, "shard2": 2048}, countShards(shrunk))
+	for logical, shard := range grown.Shards {
+		if shard != "shard0" {
+			assert.Equal(shard, shrunk.Shards[logical])
+		}
+	}
+
+	moved, err := m.Assign(7, "shard1")
+	assert.NoError(err)
+	assert.Equal("shard1", moved.Shards[7])
+	assert.Equal("shard0", m.Shards[7])
+	_, err = m.Assign(core.DefaultLogicalShards, "shard1")
+	assert.Error(err)
+
+	rowKey := []byte("row")
+	assert.Equal(m.Shards[m.Logical(rowKey)], m.Choose(rowKey))
+
+	dir, err := ioutil.TempDir("", "schemaless-shardmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "shardmap.json")
+	_, err = core.LoadShardMap(path)
+	assert.True(os.IsNotExist(err))
+	assert.NoError(grown.Save(path))
+	loaded, err := core.LoadShardMap(path)
+	assert.NoError(err)
+	assert.Equal(grown, loaded)
+}
+
+func TestShardMapMigration(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	old := []core.Shard{{Name: "shard0", Backend: memory.New()}, {Name: "shard1", Backend: memory.New()}}
+	m, err := core.NewShardMap(64, []string{"shard0", "shard1"})
+	assert.NoError(err)
+	_, err = core.NewWithShardMap(old[:1], m)
+	assert.Error(err, "shard1 has no backend")
+
+	kv, err := core.NewWithShardMap(old, m)
+	assert.NoError(err)
+	assert.Equal(m, kv.ShardMap())
+	assert.Nil(core.New(old).ShardMap())
+
+	// the map only changes through a migration, which leaves saving it to the caller
+	assert.Error(kv.AddShard(ctx, "shard2", memory.New()))
+	assert.Error(kv.DeleteShard(ctx, "shard1"))
+	assert.Equal(m, kv.ShardMap())
+
+	var cells []models.Cell
+	for i := 0; i < 50; i++ {
+		cell := newBusiness(1, "companies", "uber.com", "Uber")
+		assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+		assert.Equal(m.Choose(cell.RowKey), kv.ShardFor(cell.RowKey))
+		cells = append(cells, cell)
+	}
+
+	grown, err := m.Rebalance([]string{"shard0", "shard1", "shard2"})
+	assert.NoError(err)
+	next := append(old, core.Shard{Name: "shard2", Backend: memory.New()})
+	assert.NoError(kv.BeginShardMapMigration(next, grown))
+
+	copier := core.NewCopier(kv, core.NewMemoryCheckpointer())
+	assert.NoError(copier.Run(ctx))
+	matches, _, err := kv.GetCellsByColumnLatest(ctx, "companies")
+	assert.NoError(err)
+	assert.Len(matches, 50)
+	assert.NoError(kv.CompleteMigration())
+	assert.Equal(grown, kv.ShardMap())
+
+	for _, cell := range cells {
+		latest, found, err := kv.GetCellLatest(ctx, cell.RowKey, "companies")
+		assert.NoError(err)
+		assert.True(found)
+		assert.Equal(cell.Body, latest.Body)
+
+		// only the rows of the logical shards handed to shard2 were copied
+		_, found, err = next[2].Backend.GetCellLatest(ctx, cell.RowKey, "companies")
+		assert.NoError(err)
+		assert.Equal(grown.Choose(cell.RowKey) == "shard2", found)
+	}
+}
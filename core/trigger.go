@@ -0,0 +1,314 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"code.jogchat.internal/go-schemaless/models"
+)
+
+// TriggerHandler is called with each new cell of the column it was registered for
+type TriggerHandler func(ctx context.Context, cell models.Cell) error
+
+// TriggerStats reports the progress of Triggers on one shard
+type TriggerStats struct {
+	Shard string
+	// Checkpoint is the added_at of the last cell processed
+	Checkpoint int64
+	// Scanned counts the cells read from the shard, Delivered those handed to at least one handler
+	Scanned   int64
+	Delivered int64
+}
+
+// Triggers tails the cells of every shard by added_at and calls the handlers registered for their
+// column. The cells of a row are delivered in the order they were written, cells of different rows
+// may be delivered concurrently, see WithWorkers.
+//
+// Delivery is at least once: progress is checkpointed after every batch, and a batch whose handlers
+// failed is delivered again on the next Run, as are cells copied to a new shard by a migration.
+// Handlers must therefore be idempotent.
+//
+// Checkpoints can be moved, to replay or skip cells, with the Reset methods while no Run is in
+// progress. With a ShardCheckpointer they live on the shards themselves, under the consumer's name.
+type Triggers struct {
+	kv          *KVStore
+	checkpoints Checkpointer
+	batchSize   int
+	workers     int
+	gapGrace    time.Duration
+	handlers    map[string][]TriggerHandler
+
+	mu    sync.Mutex
+	stats map[string]*TriggerStats
+}
+
+// NewTriggers returns Triggers tailing the shards of kv, resuming from the checkpoints it finds.
+// A new Checkpointer starts from the first cell of each shard.
+func NewTriggers(kv *KVStore, checkpoints Checkpointer) *Triggers {
+	return &Triggers{
+		kv:          kv,
+		checkpoints: checkpoints,
+		batchSize:   defaultCopyBatchSize,
+		workers:     1,
+		gapGrace:    defaultGapGrace,
+		handlers:    make(map[string][]TriggerHandler),
+		stats:       make(map[string]*TriggerStats),
+	}
+}
+
+// Register adds a handler for the cells of columnKey, called after those registered before it.
+// Handlers must be registered before Run.
+func (t *Triggers) Register(columnKey string, handler TriggerHandler) *Triggers {
+	t.handlers[columnKey] = append(t.handlers[columnKey], handler)
+	return t
+}
+
+// WithBatchSize sets the number of cells read from a shard at a time
+func (t *Triggers) WithBatchSize(batchSize int) *Triggers {
+	t.batchSize = batchSize
+	return t
+}
+
+// WithGapGrace sets how long a hole in the added_at of a shard holds the cells following it back,
+// 10 seconds by default, see Run
+func (t *Triggers) WithGapGrace(grace time.Duration) *Triggers {
+	t.gapGrace = grace
+	return t
+}
+
+// WithWorkers sets the number of rows of a shard whose cells are delivered concurrently, 1 by default.
+// Run fails with fewer than one.
+func (t *Triggers) WithWorkers(workers int) *Triggers {
+	t.workers = workers
+	return t
+}
+
+// Stats returns the progress of every shard, ordered by shard name
+func (t *Triggers) Stats() []TriggerStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := make([]TriggerStats, 0, len(t.stats))
+	for _, shardStats := range t.stats {
+		stats = append(stats, *shardStats)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Shard < stats[j].Shard })
+	return stats
+}
+
+// Run delivers the cells of every shard written since its checkpoint, tailing shards concurrently,
+// until each is drained or reaches a recent hole in its added_at, see WithGapGrace. Failed shards
+// are reported as ShardErrors, running again resumes them from their checkpoint. During a migration
+// the shards of both layouts are tailed.
+func (t *Triggers) Run(ctx context.Context) error {
+	if len(t.handlers) == 0 {
+		return errors.New("no trigger registered")
+	}
+	if t.workers < 1 {
+		return fmt.Errorf("triggers need at least one worker, not %d", t.workers)
+	}
+
+	// replicas may lag, a cell missed on one would be skipped for good once the checkpoint moves past it
+	return t.eachShard(WithReadPolicy(ctx, PrimaryOnly), t.tailShard)
+}
+
+// ResetEarliest moves the checkpoint of every shard back to its first cell, so that the next Run
+// delivers every cell again
+func (t *Triggers) ResetEarliest(ctx context.Context) error {
+	return t.eachShard(ctx, func(ctx context.Context, shard string, storage Storage) error {
+		return t.reset(ctx, shard, 0)
+	})
+}
+
+// ResetLatest moves the checkpoint of every shard to its last cell, so that the next Run only
+// delivers cells written from now on
+func (t *Triggers) ResetLatest(ctx context.Context) error {
+	return t.ResetToTime(ctx, time.Time{})
+}
+
+// ResetToTime moves the checkpoint of every shard to the last cell created before at, so that the
+// next Run delivers the cells created since. Shards time cells at a resolution of a second.
+func (t *Triggers) ResetToTime(ctx context.Context, at time.Time) error {
+	return t.eachShard(ctx, func(ctx context.Context, shard string, storage Storage) error {
+		addedAt, err := storage.LastAddedAt(ctx, at)
+		if err != nil {
+			return err
+		}
+		return t.reset(ctx, shard, addedAt)
+	})
+}
+
+// ResetToOffset moves the checkpoint of shard to addedAt, so that the next Run delivers the cells
+// of shard that follow it
+func (t *Triggers) ResetToOffset(ctx context.Context, shard string, addedAt int64) error {
+	return t.reset(ctx, shard, addedAt)
+}
+
+// reset saves addedAt as the checkpoint of shard
+func (t *Triggers) reset(ctx context.Context, shard string, addedAt int64) error {
+	if err := t.checkpoints.SaveCheckpoint(ctx, shard, addedAt); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if stats, ok := t.stats[shard]; ok {
+		stats.Checkpoint = addedAt
+	}
+	return nil
+}
+
+// eachShard runs fn concurrently on every shard, of both layouts during a migration, reporting failed shards as ShardErrors
+func (t *Triggers) eachShard(ctx context.Context, fn func(ctx context.Context, shard string, storage Storage) error) error {
+	t.kv.mu.RLock()
+	// the maps are copied, as shards may be added or deleted meanwhile
+	shards := copyStorages(t.kv.storages)
+	for shard, storage := range t.kv.mstorages {
+		shards[shard] = storage
+	}
+	t.kv.mu.RUnlock()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs ShardErrors
+	)
+	for shard, storage := range shards {
+		wg.Add(1)
+		go func(shard string, storage Storage) {
+			defer wg.Done()
+			if err := fn(ctx, shard, storage); err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				if errs == nil {
+					errs = make(ShardErrors)
+				}
+				errs[shard] = err
+			}
+		}(shard, storage)
+	}
+	wg.Wait()
+
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// Loop runs the Triggers every interval until ctx is done, waiting for the next round while shards
+// are unavailable. Other failures, those of handlers included, are returned.
+func (t *Triggers) Loop(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := t.Run(ctx); err != nil && !errors.Is(err, ErrShardUnavailable) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// tailShard delivers the cells of storage that follow its checkpoint, batch by batch
+func (t *Triggers) tailShard(ctx context.Context, shard string, storage Storage) error {
+	after, err := t.checkpoints.LoadCheckpoint(ctx, shard)
+	if err != nil {
+		return err
+	}
+
+	for {
+		cells, found, err := storage.ScanCells(ctx, after, t.batchSize)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return nil
+		}
+		// a hole may be filled by a cell committing late, which the next Run delivers before what follows
+		n := settled(after, cells, t.gapGrace)
+		if n == 0 {
+			return nil
+		}
+		held := n < len(cells)
+		cells = cells[:n]
+
+		delivered, err := t.deliver(ctx, cells)
+		if err != nil {
+			return err
+		}
+		after = cells[len(cells)-1].AddedAt
+		if err := t.checkpoints.SaveCheckpoint(ctx, shard, after); err != nil {
+			return err
+		}
+
+		t.mu.Lock()
+		stats, ok := t.stats[shard]
+		if !ok {
+			stats = &TriggerStats{Shard: shard}
+			t.stats[shard] = stats
+		}
+		stats.Checkpoint = after
+		stats.Scanned += int64(len(cells))
+		stats.Delivered += delivered
+		t.mu.Unlock()
+		if held {
+			return nil
+		}
+	}
+}
+
+// deliver hands cells to their handlers, returning how many had any. Cells are spread over the
+// workers by row key, each worker delivering its cells in order and stopping at the first failure.
+func (t *Triggers) deliver(ctx context.Context, cells []models.Cell) (int64, error) {
+	partitions := make([][]models.Cell, t.workers)
+	var delivered int64
+	for _, cell := range cells {
+		if len(t.handlers[cell.ColumnName]) == 0 {
+			continue
+		}
+		i := hash64(cell.RowKey) % uint64(t.workers)
+		partitions[i] = append(partitions[i], cell)
+		delivered++
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+	)
+	for _, partition := range partitions {
+		if len(partition) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(cells []models.Cell) {
+			defer wg.Done()
+			for _, cell := range cells {
+				for _, handler := range t.handlers[cell.ColumnName] {
+					if err := handler(ctx, cell); err != nil {
+						mu.Lock()
+						defer mu.Unlock()
+						if first == nil {
+							first = err
+						}
+						return
+					}
+				}
+			}
+		}(partition)
+	}
+	wg.Wait()
+
+	if first != nil {
+		return 0, first
+	}
+	return delivered, nil
+}
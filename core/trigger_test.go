@@ -0,0 +1,223 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"code.jogchat.internal/go-schemaless/core"
+	"code.jogchat.internal/go-schemaless/models"
+	"code.jogchat.internal/go-schemaless/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTriggers(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	kv := newMemoryStore()
+	defer kv.Destroy(ctx)
+
+	var (
+		mu        sync.Mutex
+		delivered = make(map[string][]int64)
+		fail      = true
+	)
+	checkpoints := core.NewMemoryCheckpointer()
+	triggers := core.NewTriggers(kv, checkpoints).WithBatchSize(3).WithWorkers(4)
+	assert.Error(triggers.Run(ctx), "no trigger registered")
+	triggers.Register("companies", func(ctx context.Context, cell models.Cell) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delivered[string(cell.RowKey)] = append(delivered[string(cell.RowKey)], cell.RefKey)
+		return nil
+	})
+	assert.Error(triggers.WithWorkers(0).Run(ctx))
+	assert.Error(triggers.WithWorkers(-1).Run(ctx))
+	triggers.WithWorkers(4)
+
+	var rows [][]byte
+	for i := 0; i < 10; i++ {
+		cell := newBusiness(1, "companies", "uber.com", "Uber")
+		rows = append(rows, cell.RowKey)
+		for refKey := int64(1); refKey <= 3; refKey++ {
+			assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, refKey, models.NewCell(cell.RowKey, cell.ColumnName, refKey, cell.Body)))
+		}
+		school := newBusiness(1, "schools", "illinois.edu", "UIUC")
+		assert.NoError(kv.PutCell(ctx, school.RowKey, school.ColumnName, school.RefKey, school))
+	}
+
+	assert.NoError(triggers.Run(ctx))
+	assert.Len(delivered, 10, "cells of other columns are not delivered")
+	for _, rowKey := range rows {
+		assert.Equal([]int64{1, 2, 3}, delivered[string(rowKey)], "the cells of a row come in order")
+	}
+	var scanned, total int64
+	for _, stats := range triggers.Stats() {
+		scanned += stats.Scanned
+		total += stats.Delivered
+	}
+	assert.Equal(int64(40), scanned)
+	assert.Equal(int64(30), total)
+
+	// a later run only delivers what was written since
+	assert.NoError(triggers.Run(ctx))
+	next := models.NewCell(rows[0], "companies", 4, []byte(`{"name":"Uber"}`))
+	assert.NoError(kv.PutCell(ctx, next.RowKey, next.ColumnName, next.RefKey, next))
+	assert.NoError(core.NewTriggers(kv, checkpoints).Register("companies", func(ctx context.Context, cell models.Cell) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delivered[string(cell.RowKey)] = append(delivered[string(cell.RowKey)], cell.RefKey)
+		return nil
+	}).Run(ctx))
+	assert.Equal([]int64{1, 2, 3, 4}, delivered[string(rows[0])], "resumed from the checkpoints")
+
+	// a failing handler gets the cell again on the next run
+	var attempts int
+	flaky := core.NewTriggers(kv, core.NewMemoryCheckpointer()).Register("schools", func(ctx context.Context, cell models.Cell) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if fail {
+			fail = false
+			return errors.New("handler failed")
+		}
+		return nil
+	})
+	var shardErrs core.ShardErrors
+	assert.True(errors.As(flaky.Run(ctx), &shardErrs))
+	assert.Len(shardErrs, 1)
+	assert.NoError(flaky.Run(ctx))
+	assert.Equal(11, attempts)
+}
+
+func TestTriggersReset(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	kv := newMemoryStore()
+	defer kv.Destroy(ctx)
+
+	var (
+		mu        sync.Mutex
+		delivered int
+	)
+	newTriggers := func(consumer string) *core.Triggers {
+		return core.NewTriggers(kv, core.NewShardCheckpointer(kv, consumer)).Register("companies", func(ctx context.Context, cell models.Cell) error {
+			mu.Lock()
+			defer mu.Unlock()
+			delivered++
+			return nil
+		})
+	}
+	put := func(n int) {
+		for i := 0; i < n; i++ {
+			cell := newBusiness(1, "companies", "uber.com", "Uber")
+			assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+		}
+	}
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		n := delivered
+		delivered = 0
+		return n
+	}
+
+	put(10)
+	assert.NoError(newTriggers("billing").Run(ctx))
+	assert.Equal(10, count())
+
+	// checkpoints live on the shards, a restarted consumer resumes and others start over
+	put(5)
+	assert.NoError(newTriggers("billing").Run(ctx))
+	assert.Equal(5, count())
+	assert.NoError(newTriggers("search").Run(ctx))
+	assert.Equal(15, count())
+
+	triggers := newTriggers("billing")
+	assert.NoError(triggers.ResetEarliest(ctx))
+	assert.NoError(triggers.Run(ctx))
+	assert.Equal(15, count(), "replayed from the first cell")
+
+	put(3)
+	assert.NoError(triggers.ResetLatest(ctx))
+	assert.NoError(triggers.Run(ctx))
+	assert.Zero(count(), "skipped to the last cell")
+
+	put(2)
+	assert.NoError(triggers.ResetToTime(ctx, time.Now().Add(-time.Hour)))
+	assert.NoError(triggers.Run(ctx))
+	assert.Equal(20, count(), "every cell was created within the hour")
+	assert.NoError(triggers.ResetToTime(ctx, time.Now().Add(time.Hour)))
+	assert.NoError(triggers.Run(ctx))
+	assert.Zero(count())
+
+	// offsets are per shard
+	stats := triggers.Stats()
+	assert.NoError(triggers.ResetToOffset(ctx, stats[0].Shard, stats[0].Checkpoint-1))
+	assert.NoError(triggers.Run(ctx))
+	assert.Equal(1, count())
+	assert.Error(triggers.ResetToOffset(ctx, "shard9", 0), "unknown shard")
+}
+
+// uncommittedStorage hides the cell added at *pending from scans, as a transaction that took
+// its added_at but has not committed yet would
+type uncommittedStorage struct {
+	*memory.Storage
+	pending *int64
+}
+
+func (s uncommittedStorage) ScanCells(ctx context.Context, after int64, limit int) ([]models.Cell, bool, error) {
+	cells, _, err := s.Storage.ScanCells(ctx, after, limit)
+	var committed []models.Cell
+	for _, cell := range cells {
+		if cell.AddedAt != *s.pending {
+			committed = append(committed, cell)
+		}
+	}
+	return committed, len(committed) > 0, err
+}
+
+func TestTriggersAddedAtHole(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	var pending int64
+	kv := core.New([]core.Shard{{Name: "shard0", Backend: uncommittedStorage{memory.New(), &pending}}})
+	var (
+		mu        sync.Mutex
+		delivered []int64
+	)
+	triggers := core.NewTriggers(kv, core.NewMemoryCheckpointer()).Register("companies", func(ctx context.Context, cell models.Cell) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delivered = append(delivered, cell.AddedAt)
+		return nil
+	})
+	put := func(n int) {
+		for i := 0; i < n; i++ {
+			cell := newBusiness(1, "companies", "uber.com", "Uber")
+			assert.NoError(kv.PutCell(ctx, cell.RowKey, cell.ColumnName, cell.RefKey, cell))
+		}
+	}
+
+	// the cells following a recent hole wait for it to fill
+	put(5)
+	pending = 3
+	assert.NoError(triggers.Run(ctx))
+	assert.Equal([]int64{1, 2}, delivered)
+	assert.Equal(int64(2), triggers.Stats()[0].Checkpoint)
+	pending = 0
+	assert.NoError(triggers.Run(ctx))
+	assert.Equal([]int64{1, 2, 3, 4, 5}, delivered)
+
+	// past the grace, a hole is taken for a rolled back transaction
+	put(3)
+	pending = 7
+	assert.NoError(triggers.WithGapGrace(0).Run(ctx))
+	assert.Equal([]int64{1, 2, 3, 4, 5, 6, 8}, delivered)
+	assert.Equal(int64(8), triggers.Stats()[0].Checkpoint)
+}
@@ -2,52 +2,229 @@ package schemaless
 
 import (
 	"code.jogchat.internal/go-schemaless/storage/mysql"
-	"code.jogchat.internal/go-schemaless/utils"
+	"code.jogchat.internal/go-schemaless/storage/postgres"
+	"code.jogchat.internal/go-schemaless/storage/sqlite"
 	"code.jogchat.internal/go-schemaless/core"
 	"os"
 	"io/ioutil"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
 )
 
-func newBackend(user, pass, host, port, schemaName string) *mysql.Storage {
+func newBackend(user, pass, host, port, schemaName string) (*mysql.Storage, error) {
 	m := mysql.New().WithUser(user).
 		WithPass(pass).
 		WithHost(host).
 		WithPort(port).
 		WithDatabase(schemaName)
 
-	m.WithZap()
-	m.Open()
+	if err := m.WithZap(); err != nil {
+		return nil, err
+	}
+	if err := m.Open(); err != nil {
+		return nil, err
+	}
 
 	// TODO(rbastic): defer Sync() on all backend storage loggers
-	return m
+	return m, nil
+}
+
+func newPostgresBackend(user, pass, host, port, schemaName string) (*postgres.Storage, error) {
+	p := postgres.New().WithUser(user).
+		WithPass(pass).
+		WithHost(host).
+		WithPort(port).
+		WithDatabase(schemaName)
+
+	if err := p.WithZap(); err != nil {
+		return nil, err
+	}
+	if err := p.Open(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
 }
 
-func getShards(config map[string][]map[string]string) []core.Shard {
+func newSqliteBackend(path string) (*sqlite.Storage, error) {
+	s := sqlite.New().WithPath(path)
+
+	if err := s.WithZap(); err != nil {
+		return nil, err
+	}
+	if err := s.Open(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// config is the layout of config/config.json
+type config struct {
+	// Hosts lists the physical shards, see README.md
+	Hosts []map[string]string `json:"hosts"`
+	// ShardMap is the path of the file mapping logical shards to hosts. When set, row keys hash
+	// onto core.DefaultLogicalShards logical shards, spread over the hosts the first time it is created.
+	ShardMap string `json:"shard_map"`
+	// Chooser selects the sharding scheme and hash function when there is no shard map.
+	// Hosts set their share of the rows with "weight" and, for key ranges, their lowest row key with "range_start".
+	Chooser core.ChooserConfig `json:"chooser"`
+	// Buffer, set like a host, takes the writes of unavailable shards until a core.Replayer drains it
+	Buffer map[string]string `json:"buffer"`
+}
+
+// getShards opens every host, attaching those with "replica_of" to the shard of that database
+func getShards(hosts []map[string]string) ([]core.Shard, error) {
 	var shards []core.Shard
-	hosts := config["hosts"]
+	index := make(map[string]int)
+
+	// primaries first, so that replicas can be listed before them
+	for _, replicas := range []bool{false, true} {
+		for _, host := range hosts {
+			primary, isReplica := host["replica_of"]
+			if isReplica != replicas {
+				continue
+			}
+			backend, err := newHostBackend(host)
+			if err != nil {
+				return nil, fmt.Errorf("shard %s: %v", host["database"], err)
+			}
 
-	for _, host := range hosts {
-		shard := core.Shard{
-			Name: host["database"],
-			Backend: newBackend(host["user"], host["password"], host["ip"], host["port"], host["database"])}
-		shards = append(shards, shard)
+			if isReplica {
+				i, ok := index[primary]
+				if !ok {
+					return nil, fmt.Errorf("shard %s: replica of unknown shard %s", host["database"], primary)
+				}
+				shards[i].Replicas = append(shards[i].Replicas, backend)
+				continue
+			}
+
+			shard := core.Shard{Name: host["database"], Backend: backend}
+			if policy, ok := host["read_policy"]; ok {
+				if shard.ReadPolicy, err = core.ParseReadPolicy(policy); err != nil {
+					return nil, fmt.Errorf("shard %s: %v", host["database"], err)
+				}
+			}
+			index[shard.Name] = len(shards)
+			shards = append(shards, shard)
+		}
 	}
 
-	return shards
+	return shards, nil
+}
+
+// newHostBackend opens the backend of a host entry of config.json
+func newHostBackend(host map[string]string) (core.Storage, error) {
+	switch host["driver"] {
+	case "postgres":
+		return newPostgresBackend(host["user"], host["password"], host["ip"], host["port"], host["database"])
+	case "sqlite":
+		return newSqliteBackend(host["path"])
+	default:
+		return newBackend(host["user"], host["password"], host["ip"], host["port"], host["database"])
+	}
 }
 
-func InitDataStore() *core.KVStore {
+func InitDataStore() (*core.KVStore, error) {
 	jsonFile, err := os.Open("config/config.json")
-	utils.CheckErr(err)
+	if err != nil {
+		return nil, err
+	}
 	defer jsonFile.Close()
 	bytes, err := ioutil.ReadAll(jsonFile)
-	utils.CheckErr(err)
+	if err != nil {
+		return nil, err
+	}
+
+	var conf config
+	if err := json.Unmarshal(bytes, &conf); err != nil {
+		return nil, err
+	}
 
-	var config map[string][]map[string]string
-	json.Unmarshal(bytes, &config)
+	shards, err := getShards(conf.Hosts)
+	if err != nil {
+		return nil, err
+	}
+	kv, err := newKVStore(conf, shards)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Buffer != nil {
+		buffer, err := newHostBackend(conf.Buffer)
+		if err != nil {
+			return nil, fmt.Errorf("buffer: %v", err)
+		}
+		kv.WithBuffer(buffer)
+	}
+	return kv, nil
+}
 
-	shards := getShards(config)
+// newKVStore shards the keys across shards through the shard map or the chooser of conf
+func newKVStore(conf config, shards []core.Shard) (*core.KVStore, error) {
+	if conf.ShardMap == "" {
+		chooser, err := newChooser(conf)
+		if err != nil {
+			return nil, err
+		}
+		return core.NewWithChooser(shards, chooser)
+	}
+	if conf.Chooser.Kind != "" || conf.Chooser.Hash != "" {
+		return nil, errors.New("a shard map and a chooser cannot be configured together")
+	}
 
-	return core.New(shards)
+	shardMap, err := loadShardMap(conf.ShardMap, shards)
+	if err != nil {
+		return nil, err
+	}
+	return core.NewWithShardMap(shards, shardMap)
+}
+
+// loadShardMap reads the shard map at path, creating it over shards if it does not exist yet
+func loadShardMap(path string, shards []core.Shard) (*core.ShardMap, error) {
+	shardMap, err := core.LoadShardMap(path)
+	if err == nil || !os.IsNotExist(err) {
+		return shardMap, err
+	}
+
+	names := make([]string, len(shards))
+	for i, shard := range shards {
+		names[i] = shard.Name
+	}
+	shardMap, err = core.NewShardMap(core.DefaultLogicalShards, names)
+	if err != nil {
+		return nil, err
+	}
+	if err := shardMap.Save(path); err != nil {
+		return nil, err
+	}
+	return shardMap, nil
+}
+
+// newChooser builds the chooser of conf, taking the weights and range starts of its hosts
+func newChooser(conf config) (core.Chooser, error) {
+	chooserConfig := conf.Chooser
+	for _, host := range conf.Hosts {
+		if _, ok := host["replica_of"]; ok {
+			continue
+		}
+		if weight, ok := host["weight"]; ok {
+			w, err := strconv.Atoi(weight)
+			if err != nil {
+				return nil, fmt.Errorf("shard %s: weight: %v", host["database"], err)
+			}
+			if chooserConfig.Weights == nil {
+				chooserConfig.Weights = make(map[string]int)
+			}
+			chooserConfig.Weights[host["database"]] = w
+		}
+		if start, ok := host["range_start"]; ok {
+			if chooserConfig.RangeStarts == nil {
+				chooserConfig.RangeStarts = make(map[string]string)
+			}
+			chooserConfig.RangeStarts[host["database"]] = start
+		}
+	}
+	return core.NewChooser(chooserConfig)
 }
@@ -29,11 +29,12 @@ func newBusiness(id uuid.UUID, colKey string, domain string, name string) models
 func TestSchemaless(t *testing.T) {
 	assert := assert.New(t)
 
-	dataStore := InitDataStore()
+	dataStore, err := InitDataStore()
+	utils.CheckErr(err)
 	defer dataStore.Destroy(context.TODO())
 
 	UIUC := newBusiness(utils.NewUUID(), "schools", "illinois.edu", "UIUC")
-	err := dataStore.PutCell(context.TODO(), UIUC.RowKey, UIUC.ColumnName, UIUC.RefKey, UIUC)
+	err = dataStore.PutCell(context.TODO(), UIUC.RowKey, UIUC.ColumnName, UIUC.RefKey, UIUC)
 	utils.CheckErr(err)
 
 	CMU := newBusiness(utils.NewUUID(), "schools", "andrew.cmu.edu", "CMU")
@@ -0,0 +1,133 @@
+package memory
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// match evaluates `indexed <operator> value` the way the SQL backends would
+// evaluate `WHERE field <operator> ?` against an index table. Values of
+// different kinds never match, much like a failed implicit conversion.
+func match(indexed interface{}, operator string, value interface{}) (bool, error) {
+	a, b := normalize(indexed), normalize(value)
+
+	switch strings.ToUpper(strings.TrimSpace(operator)) {
+	case "=":
+		c, ok := compare(a, b)
+		return ok && c == 0, nil
+	case "!=", "<>":
+		c, ok := compare(a, b)
+		return ok && c != 0, nil
+	case "<":
+		c, ok := compare(a, b)
+		return ok && c < 0, nil
+	case "<=":
+		c, ok := compare(a, b)
+		return ok && c <= 0, nil
+	case ">":
+		c, ok := compare(a, b)
+		return ok && c > 0, nil
+	case ">=":
+		c, ok := compare(a, b)
+		return ok && c >= 0, nil
+	case "LIKE":
+		s, ok := a.(string)
+		pattern, ok2 := b.(string)
+		if !ok || !ok2 {
+			return false, nil
+		}
+		return like(s, pattern), nil
+	}
+	return false, fmt.Errorf("unsupported operator %q", operator)
+}
+
+// normalize folds the many Go representations of a value onto float64, string and bool
+func normalize(v interface{}) interface{} {
+	switch t := v.(type) {
+	case []byte:
+		return string(t)
+	case int:
+		return float64(t)
+	case int8:
+		return float64(t)
+	case int16:
+		return float64(t)
+	case int32:
+		return float64(t)
+	case int64:
+		return float64(t)
+	case uint:
+		return float64(t)
+	case uint8:
+		return float64(t)
+	case uint16:
+		return float64(t)
+	case uint32:
+		return float64(t)
+	case uint64:
+		return float64(t)
+	case float32:
+		return float64(t)
+	case string, float64, bool:
+		return t
+	case fmt.Stringer:
+		// e.g. uuid.UUID, which encoding/json writes to the body in its string form
+		return t.String()
+	}
+	return v
+}
+
+func compare(a, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	case bool:
+		y, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x == y:
+			return 0, true
+		case !x:
+			return -1, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
+
+// like implements SQL LIKE with % and _ wildcards, case-insensitively as MySQL's default collation does
+func like(s string, pattern string) bool {
+	var expr strings.Builder
+	expr.WriteString("(?is)^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			expr.WriteString(".*")
+		case '_':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String()).MatchString(s)
+}
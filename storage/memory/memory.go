@@ -0,0 +1,496 @@
+// Package memory is an in-process Schemaless store, intended for tests and
+// local development.
+package memory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"code.jogchat.internal/go-schemaless/core"
+	"code.jogchat.internal/go-schemaless/models"
+	"code.jogchat.internal/go-schemaless/utils"
+)
+
+// cellKey identifies all versions of a cell, mirroring the (row_key, column_name) prefix of cell_idx
+type cellKey struct {
+	rowKey     string
+	columnName string
+}
+
+// Storage is an in-memory storage. Like the cell table, cells are immutable
+// and keyed by row key, column name and ref key; index tables hold a single
+// value per row key, as index_<column>_<field> does.
+type Storage struct {
+	mu sync.RWMutex
+
+	addedAt     int64
+	cells       map[cellKey][]models.Cell
+	indexes     map[string]map[string]interface{}
+	checkpoints map[string]int64
+}
+
+// New returns a new in-memory Storage
+func New() *Storage {
+	s := new(Storage)
+	s.reset()
+	return s
+}
+
+func (s *Storage) reset() {
+	s.addedAt = 0
+	s.cells = make(map[cellKey][]models.Cell)
+	s.indexes = make(map[string]map[string]interface{})
+	s.checkpoints = make(map[string]int64)
+}
+
+func (s *Storage) GetCellLatest(ctx context.Context, rowKey []byte, columnKey string) (cell models.Cell, found bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return cell, false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cell, found = s.latest(string(rowKey), columnKey)
+	return cell, found, nil
+}
+
+// get the cell with an exact ref key, i.e. a specific version
+func (s *Storage) GetCell(ctx context.Context, rowKey []byte, columnKey string, refKey int64) (cell models.Cell, found bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return cell, false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key := cellKey{rowKey: string(rowKey), columnName: columnKey}
+	if i, ok := s.find(key, refKey); ok {
+		return clone(s.cells[key][i]), true, nil
+	}
+	return cell, false, nil
+}
+
+// get the versions of a cell selected by opts, ordered by ref key
+func (s *Storage) GetCellVersions(ctx context.Context, rowKey []byte, columnKey string, opts core.VersionOptions) (cells []models.Cell, found bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	versions := s.cells[cellKey{rowKey: string(rowKey), columnName: columnKey}]
+	for i := range versions {
+		version := versions[i]
+		if opts.Descending {
+			version = versions[len(versions)-1-i]
+		}
+		if opts.MinRefKey != nil && version.RefKey < *opts.MinRefKey {
+			continue
+		}
+		if opts.MaxRefKey != nil && version.RefKey > *opts.MaxRefKey {
+			continue
+		}
+		if opts.Limit > 0 && len(cells) == opts.Limit {
+			break
+		}
+		cells = append(cells, clone(version))
+	}
+	return cells, len(cells) > 0, nil
+}
+
+// get the latest cell of the given columns of a row, or of all of its columns
+func (s *Storage) GetRowLatest(ctx context.Context, rowKey []byte, columns ...string) (cells map[string]models.Cell, found bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(columns) == 0 {
+		for key := range s.cells {
+			if key.rowKey == string(rowKey) {
+				columns = append(columns, key.columnName)
+			}
+		}
+	}
+
+	cells = make(map[string]models.Cell)
+	for _, column := range columns {
+		if cell, ok := s.latest(string(rowKey), column); ok {
+			cells[column] = cell
+		}
+	}
+	return cells, len(cells) > 0, nil
+}
+
+// get the latest cell of a column for many rows at once, keyed by string(rowKey)
+func (s *Storage) MultiGetCellLatest(ctx context.Context, rowKeys [][]byte, columnKey string) (cells map[string]models.Cell, found bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cells = make(map[string]models.Cell)
+	for _, rowKey := range rowKeys {
+		if cell, ok := s.latest(string(rowKey), columnKey); ok {
+			cells[string(rowKey)] = cell
+		}
+	}
+	return cells, len(cells) > 0, nil
+}
+
+// get all latest cells with a specific column name
+func (s *Storage) GetCellsByColumnLatest(ctx context.Context, columnKey string) (cells []models.Cell, found bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for key := range s.cells {
+		if key.columnName != columnKey {
+			continue
+		}
+		if cell, ok := s.latest(key.rowKey, columnKey); ok {
+			cells = append(cells, cell)
+		}
+	}
+	sortByAddedAt(cells)
+	return cells, len(cells) > 0, nil
+}
+
+// get cell with specific field, cell must be uniquely identified by field
+func (s *Storage) GetCellByUniqueFieldLatest(ctx context.Context, columnKey string, field string, value interface{}) (cell models.Cell, found bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return cell, false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rowKeys, err := s.queryByField(columnKey, field, value, "=")
+	if err != nil {
+		return cell, false, err
+	}
+	if len(rowKeys) == 0 {
+		return cell, false, nil
+	}
+	if len(rowKeys) > 1 {
+		return cell, false, core.ErrNotUnique
+	}
+
+	cell, found = s.latest(rowKeys[0], columnKey)
+	return cell, found, nil
+}
+
+// get all latest cells with a specific value from column
+func (s *Storage) GetCellsByFieldLatest(ctx context.Context, columnKey string, field string, value interface{}, operator string) (cells []models.Cell, found bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rowKeys, err := s.queryByField(columnKey, field, value, operator)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, rowKey := range rowKeys {
+		if cell, ok := s.latest(rowKey, columnKey); ok {
+			cells = append(cells, cell)
+		}
+	}
+	sortByAddedAt(cells)
+	return cells, len(cells) > 0, nil
+}
+
+// get up to limit cells written after the given added_at, in the order they were written
+func (s *Storage) ScanCells(ctx context.Context, after int64, limit int) (cells []models.Cell, found bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, versions := range s.cells {
+		for _, version := range versions {
+			if version.AddedAt > after {
+				cells = append(cells, clone(version))
+			}
+		}
+	}
+	sortByAddedAt(cells)
+	if limit > 0 && len(cells) > limit {
+		cells = cells[:limit]
+	}
+	return cells, len(cells) > 0, nil
+}
+
+// count the cells written after the given added_at
+func (s *Storage) CountCellsAfter(ctx context.Context, after int64) (count int64, err error) {
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, versions := range s.cells {
+		for _, version := range versions {
+			if version.AddedAt > after {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+// LastAddedAt returns the highest added_at of the cells created before createdBefore, the zero time meaning any
+func (s *Storage) LastAddedAt(ctx context.Context, createdBefore time.Time) (addedAt int64, err error) {
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, versions := range s.cells {
+		for _, version := range versions {
+			if version.AddedAt > addedAt && (createdBefore.IsZero() || version.CreatedAt.Before(createdBefore)) {
+				addedAt = version.AddedAt
+			}
+		}
+	}
+	return addedAt, nil
+}
+
+// LoadCheckpoint returns the added_at saved for consumer, 0 if there is none
+func (s *Storage) LoadCheckpoint(ctx context.Context, consumer string) (addedAt int64, err error) {
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.checkpoints[consumer], nil
+}
+
+// SaveCheckpoint records addedAt for consumer
+func (s *Storage) SaveCheckpoint(ctx context.Context, consumer string, addedAt int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.checkpoints[consumer] = addedAt
+	return nil
+}
+
+// check if cell with certain field exist in the database by querying index table of given column
+func (s *Storage) CheckValueExist(ctx context.Context, columnKey string, field string, value interface{}) (found bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rowKeys, err := s.queryByField(columnKey, field, value, "=")
+	if err != nil {
+		return false, err
+	}
+	return len(rowKeys) > 0, nil
+}
+
+// insert cell, remember to pass in all fields that you do not want to index on
+func (s *Storage) PutCell(ctx context.Context, rowKey []byte, columnKey string, refKey int64, cell models.Cell, ignoreFields ...string) error {
+	cell.RowKey, cell.ColumnName, cell.RefKey = rowKey, columnKey, refKey
+	err := s.PutCells(ctx, []models.Cell{cell}, ignoreFields...)
+	if !errors.Is(err, core.ErrDuplicateCell) {
+		return err
+	}
+
+	// a retried write, cells and their index entries are written together so there is nothing to heal
+	existing, _, err := s.GetCell(ctx, rowKey, columnKey, refKey)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(existing.Body, cell.Body) {
+		return core.ErrConflictingCell
+	}
+	return nil
+}
+
+// insert cells atomically: either every cell is written or none is
+func (s *Storage) PutCells(ctx context.Context, cells []models.Cell, ignoreFields ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// decode before writing anything, so a bad body leaves no trace behind
+	bodies := make([]map[string]interface{}, len(cells))
+	for i, cell := range cells {
+		if err := json.Unmarshal(cell.Body, &bodies[i]); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.putCells(cells, bodies, ignoreFields...)
+}
+
+// PutCellIf inserts cell if the highest ref key of its row and column is expectedLatestRefKey,
+// or if there is no such cell and expectedLatestRefKey is core.NoRefKey
+func (s *Storage) PutCellIf(ctx context.Context, cell models.Cell, expectedLatestRefKey int64, ignoreFields ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(cell.Body, &body); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refKey := core.NoRefKey
+	if latest, found := s.latest(string(cell.RowKey), cell.ColumnName); found {
+		refKey = latest.RefKey
+	}
+	if refKey != expectedLatestRefKey {
+		return core.ErrPreconditionFailed
+	}
+	return s.putCells([]models.Cell{cell}, []map[string]interface{}{body}, ignoreFields...)
+}
+
+// putCells writes cells along with their decoded bodies, callers must hold s.mu
+func (s *Storage) putCells(cells []models.Cell, bodies []map[string]interface{}, ignoreFields ...string) error {
+	batch := make(map[cellKey]map[int64]bool)
+	for _, cell := range cells {
+		key := cellKey{rowKey: string(cell.RowKey), columnName: cell.ColumnName}
+		if _, ok := s.find(key, cell.RefKey); ok || batch[key][cell.RefKey] {
+			return core.ErrDuplicateCell
+		}
+		if batch[key] == nil {
+			batch[key] = make(map[int64]bool)
+		}
+		batch[key][cell.RefKey] = true
+	}
+
+	now := time.Now()
+	for _, cell := range cells {
+		key := cellKey{rowKey: string(cell.RowKey), columnName: cell.ColumnName}
+		i, _ := s.find(key, cell.RefKey)
+		s.addedAt++
+		stored := models.Cell{
+			AddedAt:    s.addedAt,
+			RowKey:     append([]byte(nil), cell.RowKey...),
+			ColumnName: cell.ColumnName,
+			RefKey:     cell.RefKey,
+			Body:       append([]byte(nil), cell.Body...),
+			CreatedAt:  &now,
+		}
+		versions := append(s.cells[key], models.Cell{})
+		copy(versions[i+1:], versions[i:])
+		versions[i] = stored
+		s.cells[key] = versions
+	}
+
+	// don't forget to propagate changes to index tables
+	for i, cell := range cells {
+		s.putAllIndex(cell.RowKey, cell.ColumnName, bodies[i], ignoreFields...)
+	}
+	return nil
+}
+
+// Destroy clears the in-memory store, and is a completely destructive operation.
+func (s *Storage) Destroy(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reset()
+	return nil
+}
+
+// find returns the position of refKey among the versions of key, or where it would be inserted, callers must hold s.mu
+func (s *Storage) find(key cellKey, refKey int64) (int, bool) {
+	versions := s.cells[key]
+	i := sort.Search(len(versions), func(i int) bool { return versions[i].RefKey >= refKey })
+	return i, i < len(versions) && versions[i].RefKey == refKey
+}
+
+// latest returns a copy of the version with the highest ref key, callers must hold s.mu
+func (s *Storage) latest(rowKey string, columnKey string) (models.Cell, bool) {
+	versions := s.cells[cellKey{rowKey: rowKey, columnName: columnKey}]
+	if len(versions) == 0 {
+		return models.Cell{}, false
+	}
+	return clone(versions[len(versions)-1]), true
+}
+
+// putAllIndex mirrors mysql's index maintenance: one value per row key in each index table
+func (s *Storage) putAllIndex(rowKey []byte, columnKey string, body map[string]interface{}, ignoreFields ...string) {
+	ignore := make(map[string]bool)
+	for _, field := range ignoreFields {
+		ignore[field] = true
+	}
+
+	for field, value := range body {
+		if ignore[field] {
+			continue
+		}
+		table := utils.IndexTableName(columnKey, field)
+		index, ok := s.indexes[table]
+		if !ok {
+			index = make(map[string]interface{})
+			s.indexes[table] = index
+		}
+		index[string(rowKey)] = value
+	}
+}
+
+// queryByField returns the row keys whose indexed value matches, callers must hold s.mu
+func (s *Storage) queryByField(columnKey string, field string, value interface{}, operator string) ([]string, error) {
+	var rowKeys []string
+	for rowKey, indexed := range s.indexes[utils.IndexTableName(columnKey, field)] {
+		ok, err := match(indexed, operator, value)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			rowKeys = append(rowKeys, rowKey)
+		}
+	}
+	sort.Strings(rowKeys)
+	return rowKeys, nil
+}
+
+func clone(cell models.Cell) models.Cell {
+	cell.RowKey = append([]byte(nil), cell.RowKey...)
+	cell.Body = append([]byte(nil), cell.Body...)
+	return cell
+}
+
+// sortByAddedAt orders cells the way a scan of the cell table's primary key would
+func sortByAddedAt(cells []models.Cell) {
+	sort.Slice(cells, func(i, j int) bool { return cells[i].AddedAt < cells[j].AddedAt })
+}
@@ -0,0 +1,43 @@
+package memory
+
+import (
+	"testing"
+
+	"code.jogchat.internal/go-schemaless/core"
+	"code.jogchat.internal/go-schemaless/storagetest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	storagetest.StorageTest(t, func() core.Storage { return New() })
+}
+
+func TestMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		indexed  interface{}
+		operator string
+		value    interface{}
+		want     bool
+	}{
+		{"illinois.edu", "=", "illinois.edu", true},
+		{"illinois.edu", "=", []byte("illinois.edu"), true},
+		{float64(30), "=", 30, true},
+		{float64(30), ">", int64(20), true},
+		{float64(30), "<=", 20, false},
+		{"b", "<>", "a", true},
+		{"Illinois.edu", "like", "%.EDU", true},
+		{"illinois.edu", "LIKE", "illinois_edu", true},
+		{"30", "=", 30, false},
+		{true, "=", true, true},
+	}
+	for _, tt := range tests {
+		got, err := match(tt.indexed, tt.operator, tt.value)
+		assert.NoError(err)
+		assert.Equal(tt.want, got, "%v %s %v", tt.indexed, tt.operator, tt.value)
+	}
+
+	_, err := match("a", "; DROP TABLE cell", "a")
+	assert.Error(err)
+}
@@ -0,0 +1,35 @@
+package mysql
+
+import (
+	"context"
+	sqldriver "database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+
+	"code.jogchat.internal/go-schemaless/core"
+	mysqldriver "github.com/go-sql-driver/mysql"
+)
+
+// ER_DUP_ENTRY, raised when the cell_idx unique key is violated
+const errDupEntry = 1062
+
+// classify wraps driver errors that have a meaning to callers into the matching core error
+func classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	// the caller's own deadline or cancellation, which a net.Error check would take for the shard's
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return err
+	}
+	var mysqlErr *mysqldriver.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == errDupEntry {
+		return fmt.Errorf("%w: %v", core.ErrDuplicateCell, err)
+	}
+	var netErr net.Error
+	if errors.Is(err, sqldriver.ErrBadConn) || errors.Is(err, mysqldriver.ErrInvalidConn) || errors.As(err, &netErr) {
+		return fmt.Errorf("%w: %v", core.ErrShardUnavailable, err)
+	}
+	return err
+}
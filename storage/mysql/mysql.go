@@ -2,16 +2,20 @@
 package mysql
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"strings"
 	_ "github.com/go-sql-driver/mysql"
+	"code.jogchat.internal/go-schemaless/core"
 	"code.jogchat.internal/go-schemaless/models"
 	"go.uber.org/zap"
 	"time"
 	"encoding/json"
 	"code.jogchat.internal/go-schemaless/utils"
-	"github.com/pkg/errors"
 )
 
 // Storage is a MySQL-backed storage.
@@ -26,20 +30,54 @@ type Storage struct {
 	Sugar	*zap.SugaredLogger
 }
 
+// batchSize bounds the cells or row keys of a single multi-row statement, keeping it under the placeholder limit
+const batchSize = 1000
+
 const (
 	driver = "mysql"
-	dsnFormat = "%s:%s@tcp(%s:%s)/%s?parseTime=true"
+	dsnFormat = "%s:%s@tcp(%s:%s)/%s?parseTime=true&time_zone=%%27%%2B00%%3A00%%27" // created_at is stamped and compared in UTC
 
+	// must provide row_key, column_name and ref_key
+	getCellSQL					= "SELECT added_at, row_key, column_name, ref_key, body, created_at FROM cell " +
+		"WHERE row_key = ? AND column_name = ? AND ref_key = ?"
+	// must provide row_key and column_name, ref key bounds, order and limit are appended
+	getCellVersionsSQL			= "SELECT added_at, row_key, column_name, ref_key, body, created_at FROM cell " +
+		"WHERE row_key = ? AND column_name = ?"
 	// must provide row_key and column_name
 	getCellLatestSQL    		= "SELECT added_at, row_key, column_name, ref_key, body, created_at FROM cell " +
 		"WHERE row_key = ? AND column_name = ? ORDER BY ref_key DESC LIMIT 1"
+	// latest cell of every column of a row, a column_name IN (...) filter and GROUP BY are appended
+	getRowLatestSQL			= "SELECT added_at, row_key, column_name, ref_key, body, created_at FROM cell " +
+		"WHERE row_key = ? AND (column_name, ref_key) IN (SELECT column_name, MAX(ref_key) FROM cell WHERE row_key = ?"
+	// latest cell of a column for many rows, a row_key IN (...) filter and GROUP BY are appended
+	multiGetCellLatestSQL	= "SELECT added_at, row_key, column_name, ref_key, body, created_at FROM cell " +
+		"WHERE column_name = ? AND (row_key, ref_key) IN (SELECT row_key, MAX(ref_key) FROM cell WHERE column_name = ?"
 	// get all latest cells with a specific column name
 	getCellsByColumnLatestSQL	= "SELECT added_at, row_key, column_name, ref_key, body, created_at FROM cell " +
-		"WHERE column_name = ? AND (row_key, ref_key) IN (SELECT row_key, MAX(ref_key) FROM cell GROUP BY row_key);"
+		"WHERE column_name = ? AND (row_key, ref_key) IN (SELECT row_key, MAX(ref_key) FROM cell WHERE column_name = ? GROUP BY row_key);"
 	// get all latest cells with a specific value from column
 	getCellsByFieldLatestSQL	= "SELECT added_at, cell.row_key, column_name, ref_key, body, created_at FROM (cell RIGHT JOIN %s ON cell.row_key = %s.row_key) " +
-		"WHERE %s %s ? AND (cell.row_key, ref_key) IN (SELECT row_key, MAX(ref_key) FROM cell GROUP BY row_key);"
+		"WHERE column_name = ? AND %s %s ? AND (cell.row_key, ref_key) IN (SELECT row_key, MAX(ref_key) FROM cell WHERE column_name = ? GROUP BY row_key);"
+	// cells written after an added_at, in the order they were written, a limit is appended
+	scanCellsSQL				= "SELECT added_at, row_key, column_name, ref_key, body, created_at FROM cell " +
+		"WHERE added_at > ? ORDER BY added_at ASC"
+	countCellsAfterSQL			= "SELECT COUNT(*) FROM cell WHERE added_at > ?"
+	lastAddedAtSQL				= "SELECT COALESCE(MAX(added_at), 0) FROM cell"
+	lastAddedAtBeforeSQL		= "SELECT COALESCE(MAX(added_at), 0) FROM cell WHERE created_at < ?"
+	// the checkpoint table holds an added_at per consumer, see schemaless_tables.md
+	loadCheckpointSQL			= "SELECT added_at FROM checkpoint WHERE consumer = ?"
+	saveCheckpointSQL			= "INSERT INTO checkpoint (consumer, added_at) VALUES (?, ?) ON DUPLICATE KEY UPDATE added_at = ?"
 	putCellSQL          		= "INSERT INTO cell (row_key, column_name, ref_key, body) VALUES(?, ?, ?, ?)"
+	// inserts only if the highest ref key of the row and column, or the given default without any, is the expected one
+	putCellIfSQL				= "INSERT INTO cell (row_key, column_name, ref_key, body) SELECT ?, ?, ?, ? FROM DUAL " +
+		"WHERE COALESCE((SELECT MAX(ref_key) FROM cell WHERE row_key = ? AND column_name = ?), ?) = ?"
+	// named locks serializing the conditional writes of a cell, held until its index tables are written
+	getLockSQL					= "SELECT GET_LOCK(?, ?)"
+	releaseLockSQL				= "SELECT RELEASE_LOCK(?)"
+	// lockTimeout is the number of seconds PutCellIf waits for the lock of a cell
+	lockTimeout					= 10
+	// multi-row insert, a further (?, ?, ?, ?) tuple is appended per additional cell
+	putCellsSQL          		= "INSERT INTO cell (row_key, column_name, ref_key, body) VALUES (?, ?, ?, ?)"
 	insertIndexSQL				= "INSERT INTO %s (row_key, %s) VALUES (?, ?) ON DUPLICATE KEY UPDATE %s = ?"
 	queryIndexSQL				= "SELECT row_key FROM %s WHERE %s %s ?"
 )
@@ -49,17 +87,22 @@ func New() *Storage {
 	return new(Storage)
 }
 
-func (s *Storage) WithZap() {
+func (s *Storage) WithZap() error {
 	logger, err := zap.NewProduction()
-	utils.CheckErr(err)
-	sug := logger.Sugar()
-	s.Sugar = sug
+	if err != nil {
+		return err
+	}
+	s.Sugar = logger.Sugar()
+	return nil
 }
 
-func (s *Storage) Open() {
+func (s *Storage) Open() error {
 	db, err := sql.Open(driver, fmt.Sprintf(dsnFormat, s.user, s.pass, s.host, s.port, s.database))
-	utils.CheckErr(err)
+	if err != nil {
+		return classify(err)
+	}
 	s.store = db
+	return nil
 }
 
 func (s *Storage) WithUser(user string) *Storage {
@@ -88,6 +131,18 @@ func (s *Storage) WithDatabase(database string) *Storage {
 }
 
 func (s *Storage) GetCellLatest(ctx context.Context, rowKey []byte, columnKey string) (cell models.Cell, found bool, err error) {
+	s.Sugar.Infow("GetCellLatest", "query ", getCellLatestSQL, "rowKey", rowKey, "columnKey", columnKey)
+	return s.getCell(ctx, getCellLatestSQL, rowKey, columnKey)
+}
+
+// get the cell with an exact ref key, i.e. a specific version
+func (s *Storage) GetCell(ctx context.Context, rowKey []byte, columnKey string, refKey int64) (cell models.Cell, found bool, err error) {
+	s.Sugar.Infow("GetCell", "query ", getCellSQL, "rowKey", rowKey, "columnKey", columnKey, "refKey", refKey)
+	return s.getCell(ctx, getCellSQL, rowKey, columnKey, refKey)
+}
+
+// helper function reading at most one cell
+func (s *Storage) getCell(ctx context.Context, query string, args ...interface{}) (cell models.Cell, found bool, err error) {
 	var (
 		resAddedAt   int64
 		resRowKey    []byte
@@ -97,15 +152,18 @@ func (s *Storage) GetCellLatest(ctx context.Context, rowKey []byte, columnKey st
 		resCreatedAt *time.Time
 		rows         *sql.Rows
 	)
-	s.Sugar.Infow("GetCellLatest", "query ", getCellLatestSQL, "rowKey", rowKey, "columnKey", columnKey)
-	rows, err = s.store.QueryContext(ctx, getCellLatestSQL, rowKey, columnKey)
-	utils.CheckErr(err)
+	rows, err = s.store.QueryContext(ctx, query, args...)
+	if err != nil {
+		return cell, false, classify(err)
+	}
 	defer rows.Close()
 
 	found = false
 	for rows.Next() {
 		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt)
-		utils.CheckErr(err)
+		if err != nil {
+			return cell, false, classify(err)
+		}
 		cell.AddedAt = resAddedAt
 		cell.RowKey = resRowKey
 		cell.ColumnName = resColName
@@ -116,10 +174,129 @@ func (s *Storage) GetCellLatest(ctx context.Context, rowKey []byte, columnKey st
 	}
 
 	err = rows.Err()
-	utils.CheckErr(err)
+	if err != nil {
+		return cell, false, classify(err)
+	}
 	return cell, found, nil
 }
 
+// get the versions of a cell selected by opts, ordered by ref key
+func (s *Storage) GetCellVersions(ctx context.Context, rowKey []byte, columnKey string, opts core.VersionOptions) (cells []models.Cell, found bool, err error) {
+	query := getCellVersionsSQL
+	args := []interface{}{rowKey, columnKey}
+	if opts.MinRefKey != nil {
+		query += " AND ref_key >= ?"
+		args = append(args, *opts.MinRefKey)
+	}
+	if opts.MaxRefKey != nil {
+		query += " AND ref_key <= ?"
+		args = append(args, *opts.MaxRefKey)
+	}
+	if opts.Descending {
+		query += " ORDER BY ref_key DESC"
+	} else {
+		query += " ORDER BY ref_key ASC"
+	}
+	if opts.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, opts.Limit)
+	}
+	s.Sugar.Infow("GetCellVersions", "query ", query, "rowKey", rowKey, "columnKey", columnKey)
+	return s.getCells(ctx, query, args...)
+}
+
+// helper function reading any number of cells
+func (s *Storage) getCells(ctx context.Context, query string, args ...interface{}) (cells []models.Cell, found bool, err error) {
+	var (
+		resAddedAt   int64
+		resRowKey    []byte
+		resColName   string
+		resRefKey    int64
+		resBody      []byte
+		resCreatedAt *time.Time
+		rows         *sql.Rows
+	)
+	rows, err = s.store.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, false, classify(err)
+	}
+	defer rows.Close()
+
+	found = false
+	for rows.Next() {
+		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt)
+		if err != nil {
+			return nil, false, classify(err)
+		}
+		cells = append(cells, models.Cell{
+			AddedAt:    resAddedAt,
+			RowKey:     resRowKey,
+			ColumnName: resColName,
+			RefKey:     resRefKey,
+			Body:       resBody,
+			CreatedAt:  resCreatedAt,
+		})
+		found = true
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, false, classify(err)
+	}
+	return cells, found, nil
+}
+
+// get the latest cell of the given columns of a row, or of all of its columns
+func (s *Storage) GetRowLatest(ctx context.Context, rowKey []byte, columns ...string) (cells map[string]models.Cell, found bool, err error) {
+	query := getRowLatestSQL
+	args := []interface{}{rowKey, rowKey}
+	if len(columns) > 0 {
+		query += " AND column_name IN (?" + strings.Repeat(", ?", len(columns)-1) + ")"
+		for _, column := range columns {
+			args = append(args, column)
+		}
+	}
+	query += " GROUP BY column_name)"
+	s.Sugar.Infow("GetRowLatest", "query ", query, "rowKey", rowKey, "columns", columns)
+
+	latest, found, err := s.getCells(ctx, query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	cells = make(map[string]models.Cell)
+	for _, cell := range latest {
+		cells[cell.ColumnName] = cell
+	}
+	return cells, found, nil
+}
+
+// get the latest cell of a column for many rows at once, keyed by string(rowKey)
+func (s *Storage) MultiGetCellLatest(ctx context.Context, rowKeys [][]byte, columnKey string) (cells map[string]models.Cell, found bool, err error) {
+	s.Sugar.Infow("MultiGetCellLatest", "rowKeys", len(rowKeys), "columnKey", columnKey)
+	cells = make(map[string]models.Cell)
+	for start := 0; start < len(rowKeys); start += batchSize {
+		end := start + batchSize
+		if end > len(rowKeys) {
+			end = len(rowKeys)
+		}
+		batch := rowKeys[start:end]
+		args := []interface{}{columnKey, columnKey}
+		for _, rowKey := range batch {
+			args = append(args, rowKey)
+		}
+		query := multiGetCellLatestSQL + " AND row_key IN (?" + strings.Repeat(", ?", len(batch)-1) + ") GROUP BY row_key)"
+
+		latest, _, err := s.getCells(ctx, query, args...)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, cell := range latest {
+			cells[string(cell.RowKey)] = cell
+		}
+	}
+	return cells, len(cells) > 0, nil
+}
+
 // get all latest cells with a specific column name
 func (s *Storage) GetCellsByColumnLatest(ctx context.Context, columnKey string) (cells []models.Cell, found bool, err error) {
 	var (
@@ -133,14 +310,18 @@ func (s *Storage) GetCellsByColumnLatest(ctx context.Context, columnKey string)
 		rows         *sql.Rows
 	)
 	stmt := fmt.Sprintf(getCellsByColumnLatestSQL)
-	rows, err = s.store.QueryContext(ctx, stmt, columnKey)
-	utils.CheckErr(err)
+	rows, err = s.store.QueryContext(ctx, stmt, columnKey, columnKey)
+	if err != nil {
+		return nil, false, classify(err)
+	}
 	defer rows.Close()
 
 	found = false
 	for rows.Next() {
 		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt)
-		utils.CheckErr(err)
+		if err != nil {
+			return nil, false, classify(err)
+		}
 		cell.AddedAt = resAddedAt
 		cell.RowKey = resRowKey
 		cell.ColumnName = resColName
@@ -150,18 +331,26 @@ func (s *Storage) GetCellsByColumnLatest(ctx context.Context, columnKey string)
 		cells = append(cells, cell)
 		found = true
 	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, false, classify(err)
+	}
 	return cells, found, nil
 }
 
 // get cell with specific field, cell must be uniquely identified by field
 func (s *Storage) GetCellByUniqueFieldLatest(ctx context.Context, columnKey string, field string, value interface{}) (cell models.Cell, found bool, err error) {
 	// Add Index table if not exist
-	rowKeys := QueryByField(ctx, s.store, columnKey, field, value, "=")
+	rowKeys, err := QueryByField(ctx, s.store, columnKey, field, value, "=")
+	if err != nil {
+		return cell, false, err
+	}
 	if len(rowKeys) == 0 {
 		return cell, false, nil
 	}
 	if len(rowKeys) > 1 {
-		panic(errors.New("field value not unique"))
+		return cell, false, core.ErrNotUnique
 	}
 
 	return s.GetCellLatest(ctx, rowKeys[0], columnKey)
@@ -181,14 +370,18 @@ func (s *Storage) GetCellsByFieldLatest(ctx context.Context, columnKey string, f
 	)
 	indexTable := utils.IndexTableName(columnKey, field)
 	stmt := fmt.Sprintf(getCellsByFieldLatestSQL, indexTable, indexTable, field, operator)
-	rows, err = s.store.QueryContext(ctx, stmt, value)
-	utils.CheckErr(err)
+	rows, err = s.store.QueryContext(ctx, stmt, columnKey, value, columnKey)
+	if err != nil {
+		return nil, false, classify(err)
+	}
 	defer rows.Close()
 
 	found = false
 	for rows.Next() {
 		err = rows.Scan(&resAddedAt, &resRowKey, &resColName, &resRefKey, &resBody, &resCreatedAt)
-		utils.CheckErr(err)
+		if err != nil {
+			return nil, false, classify(err)
+		}
 		cell.AddedAt = resAddedAt
 		cell.RowKey = resRowKey
 		cell.ColumnName = resColName
@@ -198,19 +391,86 @@ func (s *Storage) GetCellsByFieldLatest(ctx context.Context, columnKey string, f
 		cells = append(cells, cell)
 		found = true
 	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, false, classify(err)
+	}
 	return cells, found, nil
 }
 
+// get up to limit cells written after the given added_at, in the order they were written
+func (s *Storage) ScanCells(ctx context.Context, after int64, limit int) (cells []models.Cell, found bool, err error) {
+	query := scanCellsSQL
+	args := []interface{}{after}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	s.Sugar.Infow("ScanCells", "query ", query, "after", after, "limit", limit)
+	return s.getCells(ctx, query, args...)
+}
+
+// count the cells written after the given added_at
+func (s *Storage) CountCellsAfter(ctx context.Context, after int64) (count int64, err error) {
+	err = s.store.QueryRowContext(ctx, countCellsAfterSQL, after).Scan(&count)
+	if err != nil {
+		return 0, classify(err)
+	}
+	return count, nil
+}
+
+// LastAddedAt returns the highest added_at of the cells created before createdBefore, the zero time meaning any
+func (s *Storage) LastAddedAt(ctx context.Context, createdBefore time.Time) (addedAt int64, err error) {
+	if createdBefore.IsZero() {
+		err = s.store.QueryRowContext(ctx, lastAddedAtSQL).Scan(&addedAt)
+	} else {
+		err = s.store.QueryRowContext(ctx, lastAddedAtBeforeSQL, createdBefore.UTC()).Scan(&addedAt)
+	}
+	if err != nil {
+		return 0, classify(err)
+	}
+	return addedAt, nil
+}
+
+// LoadCheckpoint returns the added_at saved for consumer in the checkpoint table, 0 if there is none
+func (s *Storage) LoadCheckpoint(ctx context.Context, consumer string) (addedAt int64, err error) {
+	err = s.store.QueryRowContext(ctx, loadCheckpointSQL, consumer).Scan(&addedAt)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, classify(err)
+	}
+	return addedAt, nil
+}
+
+// SaveCheckpoint records addedAt for consumer in the checkpoint table
+func (s *Storage) SaveCheckpoint(ctx context.Context, consumer string, addedAt int64) error {
+	s.Sugar.Infow("SaveCheckpoint", "consumer", consumer, "addedAt", addedAt)
+	_, err := s.store.ExecContext(ctx, saveCheckpointSQL, consumer, addedAt, addedAt)
+	return classify(err)
+}
+
 // check if cell with certain field exist in the database by querying index table of given column
 func (s *Storage) CheckValueExist(ctx context.Context, columnKey string, field string, value interface{}) (found bool, err error) {
-	return CheckValueExist(ctx, s.store, columnKey, field, value), nil
+	return CheckValueExist(ctx, s.store, columnKey, field, value)
 }
 
 // helper function used when inserting cells, insert to or update index table when inserting cells
-func (s *Storage) putAllIndex(ctx context.Context, rowKey []byte, columnKey string, cell models.Cell, ignore_fields ...string) {
+func (s *Storage) putAllIndex(ctx context.Context, conn execer, rowKey []byte, columnKey string, cell models.Cell, ignore_fields ...string) error {
+	index := newIndexWriter(conn)
+	defer index.Close()
+	return s.indexCell(ctx, index, rowKey, columnKey, cell, ignore_fields...)
+}
+
+// indexCell writes the index entries of cell through index, which a batch of cells shares
+func (s *Storage) indexCell(ctx context.Context, index *indexWriter, rowKey []byte, columnKey string, cell models.Cell, ignore_fields ...string) error {
 	var body map[string]interface{}
 	err := json.Unmarshal(cell.Body, &body)
-	utils.CheckErr(err)
+	if err != nil {
+		return classify(err)
+	}
 
 	ignore_fields_ := make(map[string]bool)
 	for _, field := range ignore_fields {
@@ -219,32 +479,154 @@ func (s *Storage) putAllIndex(ctx context.Context, rowKey []byte, columnKey stri
 
 	for field, value := range body {
 		if _, ok := ignore_fields_[field]; !ok {
-			PutIndex(ctx, s.store, columnKey, field, rowKey, value)
+			if err := index.put(ctx, columnKey, field, rowKey, value); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
 }
 
 // insert cell, remember to pass in all fields that you do not want to index on
 func (s *Storage) PutCell(ctx context.Context, rowKey []byte, columnKey string, refKey int64, cell models.Cell, ignore_fileds ...string) (err error) {
 	var stmt *sql.Stmt
 	stmt, err = s.store.PrepareContext(ctx, putCellSQL)
-	utils.CheckErr(err)
+	if err != nil {
+		return classify(err)
+	}
+	defer stmt.Close()
 	var res sql.Result
 	s.Sugar.Infow("PutCell", "rowKey", rowKey, "columnKey", columnKey, "refKey", refKey, "Body", cell.Body)
-	res, err = stmt.Exec(rowKey, columnKey, refKey, cell.Body)
-	utils.CheckErr(err)
+	res, err = stmt.ExecContext(ctx, rowKey, columnKey, refKey, cell.Body)
+	if err != nil {
+		if err = classify(err); errors.Is(err, core.ErrDuplicateCell) {
+			return s.rewriteCell(ctx, rowKey, columnKey, refKey, cell, ignore_fileds...)
+		}
+		return err
+	}
 	var lastID int64
 	lastID, err = res.LastInsertId()
-	utils.CheckErr(err)
+	if err != nil {
+		return classify(err)
+	}
 	var rowCnt int64
 	rowCnt, err = res.RowsAffected()
-	utils.CheckErr(err)
+	if err != nil {
+		return classify(err)
+	}
 	// TODO(rbastic): Should we side-affect the cell and record the AddedAt?
 	s.Sugar.Infof("ID = %d, affected = %d\n", lastID, rowCnt)
 
 	// don't forget to propagate changes to index tables
-	s.putAllIndex(ctx, rowKey, columnKey, cell, ignore_fileds...)
-	return
+	return s.putAllIndex(ctx, s.store, rowKey, columnKey, cell, ignore_fileds...)
+}
+
+// rewriteCell handles a PutCell of a cell that exists already, as when a write is retried. The index
+// tables are written again if it is the latest version, healing a write that failed half way through.
+func (s *Storage) rewriteCell(ctx context.Context, rowKey []byte, columnKey string, refKey int64, cell models.Cell, ignoreFields ...string) error {
+	existing, found, err := s.GetCell(ctx, rowKey, columnKey, refKey)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return core.ErrDuplicateCell
+	}
+	latest, _, err := s.GetCellLatest(ctx, rowKey, columnKey)
+	if err != nil {
+		return err
+	}
+	if latest.RefKey == refKey {
+		if err := s.putAllIndex(ctx, s.store, rowKey, columnKey, existing, ignoreFields...); err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(existing.Body, cell.Body) {
+		return core.ErrConflictingCell
+	}
+	return nil
+}
+
+// PutCellIf inserts cell if the highest ref key of its row and column is expectedLatestRefKey, checking
+// and inserting in a single statement, remember to pass in all fields that you do not want to index on
+func (s *Storage) PutCellIf(ctx context.Context, cell models.Cell, expectedLatestRefKey int64, ignoreFields ...string) (err error) {
+	// named locks belong to a session, the lock must be taken and released on the same connection
+	var conn *sql.Conn
+	conn, err = s.store.Conn(ctx)
+	if err != nil {
+		return classify(err)
+	}
+	defer conn.Close()
+
+	h := fnv.New64a()
+	h.Write(cell.RowKey)
+	h.Write([]byte(cell.ColumnName))
+	lock := fmt.Sprintf("schemaless_cell_%016x", h.Sum64())
+	var acquired sql.NullInt64
+	if err = conn.QueryRowContext(ctx, getLockSQL, lock, lockTimeout).Scan(&acquired); err != nil {
+		return classify(err)
+	}
+	if acquired.Int64 != 1 {
+		return fmt.Errorf("%w: could not lock cell %s", core.ErrShardUnavailable, lock)
+	}
+	defer conn.ExecContext(context.Background(), releaseLockSQL, lock)
+
+	s.Sugar.Infow("PutCellIf", "rowKey", cell.RowKey, "columnKey", cell.ColumnName, "refKey", cell.RefKey, "expected", expectedLatestRefKey)
+	var res sql.Result
+	res, err = conn.ExecContext(ctx, putCellIfSQL, cell.RowKey, cell.ColumnName, cell.RefKey, cell.Body,
+		cell.RowKey, cell.ColumnName, core.NoRefKey, expectedLatestRefKey)
+	if err != nil {
+		return classify(err)
+	}
+	var rowCnt int64
+	rowCnt, err = res.RowsAffected()
+	if err != nil {
+		return classify(err)
+	}
+	if rowCnt == 0 {
+		return core.ErrPreconditionFailed
+	}
+	return s.putAllIndex(ctx, s.store, cell.RowKey, cell.ColumnName, cell, ignoreFields...)
+}
+
+// insert cells in a single transaction, using multi-row inserts, remember to pass in all fields that you do not want to index on
+func (s *Storage) PutCells(ctx context.Context, cells []models.Cell, ignoreFields ...string) (err error) {
+	if len(cells) == 0 {
+		return nil
+	}
+	s.Sugar.Infow("PutCells", "cells", len(cells))
+
+	var tx *sql.Tx
+	tx, err = s.store.BeginTx(ctx, nil)
+	if err != nil {
+		return classify(err)
+	}
+	for start := 0; start < len(cells); start += batchSize {
+		end := start + batchSize
+		if end > len(cells) {
+			end = len(cells)
+		}
+		batch := cells[start:end]
+		args := make([]interface{}, 0, 4*len(batch))
+		for _, cell := range batch {
+			args = append(args, cell.RowKey, cell.ColumnName, cell.RefKey, cell.Body)
+		}
+		_, err = tx.ExecContext(ctx, putCellsSQL+strings.Repeat(", (?, ?, ?, ?)", len(batch)-1), args...)
+		if err != nil {
+			tx.Rollback()
+			return classify(err)
+		}
+	}
+	// the index tables are written in the same transaction, a failed batch leaves none of its entries,
+	// and each of them through a single prepared statement
+	index := newIndexWriter(tx)
+	defer index.Close()
+	for _, cell := range cells {
+		if err = s.indexCell(ctx, index, cell.RowKey, cell.ColumnName, cell, ignoreFields...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return classify(tx.Commit())
 }
 
 // Destroy closes the in-memory store, and is a completely destructive operation.
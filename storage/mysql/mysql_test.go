@@ -0,0 +1,88 @@
+package mysql
+
+import (
+	"context"
+	sqldriver "database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"code.jogchat.internal/go-schemaless/core"
+	"code.jogchat.internal/go-schemaless/storagetest"
+	"code.jogchat.internal/go-schemaless/utils"
+)
+
+// same layout as schemaless_tables.md, created on the fly so a blank local database is enough
+const createCellTableSQL = "CREATE TABLE IF NOT EXISTS cell (" +
+	"added_at BIGINT PRIMARY KEY AUTO_INCREMENT, " +
+	"row_key BINARY(16) NOT NULL, " +
+	"column_name VARCHAR(64) NOT NULL, " +
+	"ref_key BIGINT NOT NULL, " +
+	"body BLOB, " +
+	"created_at DATETIME DEFAULT CURRENT_TIMESTAMP, " +
+	"CONSTRAINT cell_idx UNIQUE(row_key, column_name, ref_key)) ENGINE=InnoDB"
+
+const createCheckpointTableSQL = "CREATE TABLE IF NOT EXISTS checkpoint (" +
+	"consumer VARCHAR(64) NOT NULL PRIMARY KEY, " +
+	"added_at BIGINT NOT NULL) ENGINE=InnoDB"
+
+// newTestStorage connects to the MySQL described by MYSQLUSER, MYSQLPASS, SQLHOST and MYSQLDATABASE
+func newTestStorage(t *testing.T) *Storage {
+	user := os.Getenv("MYSQLUSER")
+	if user == "" {
+		t.Skip("MYSQLUSER not set, skipping mysql tests")
+	}
+	host := os.Getenv("SQLHOST")
+	if host == "" {
+		host = "localhost"
+	}
+	database := os.Getenv("MYSQLDATABASE")
+	if database == "" {
+		database = "schemaless"
+	}
+
+	m := New().WithUser(user).
+		WithPass(os.Getenv("MYSQLPASS")).
+		WithHost(host).
+		WithPort("3306").
+		WithDatabase(database)
+	if err := m.WithZap(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestMySQLStorage(t *testing.T) {
+	m := newTestStorage(t)
+	_, err := m.store.Exec(createCellTableSQL)
+	utils.CheckErr(err)
+	_, err = m.store.Exec(createCheckpointTableSQL)
+	utils.CheckErr(err)
+	for field, sqlType := range storagetest.IndexedFields {
+		table := utils.IndexTableName(storagetest.Column, field)
+		_, err = m.store.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s %s NOT NULL, row_key BINARY(16) NOT NULL UNIQUE, "+
+			"PRIMARY KEY (%s, row_key)) ENGINE=InnoDB", table, field, sqlType, field))
+		utils.CheckErr(err)
+	}
+	m.store.Close()
+
+	storagetest.StorageTest(t, func() core.Storage { return newTestStorage(t) })
+}
+
+func TestClassify(t *testing.T) {
+	for _, err := range []error{context.DeadlineExceeded, context.Canceled, fmt.Errorf("query: %w", context.DeadlineExceeded)} {
+		if classified := classify(err); errors.Is(classified, core.ErrShardUnavailable) || classified != err {
+			t.Errorf("%v: got %v, the caller's context error must be kept", err, classified)
+		}
+	}
+	for _, err := range []error{sqldriver.ErrBadConn, &net.OpError{Op: "dial", Err: errors.New("connection refused")}} {
+		if classified := classify(err); !errors.Is(classified, core.ErrShardUnavailable) {
+			t.Errorf("%v: got %v, want ErrShardUnavailable", err, classified)
+		}
+	}
+}
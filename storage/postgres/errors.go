@@ -0,0 +1,52 @@
+package postgres
+
+import (
+	"context"
+	sqldriver "database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+
+	"code.jogchat.internal/go-schemaless/core"
+	"github.com/lib/pq"
+)
+
+const (
+	// unique_violation, raised when the cell_idx unique key is violated
+	uniqueViolation = "23505"
+	// connection_exception, raised when the server cannot be reached or dropped the connection
+	connectionException = "08"
+)
+
+// the operator intervention codes meaning the server is going away or not accepting connections yet
+var unavailableCodes = map[pq.ErrorCode]bool{
+	"57P01": true, // admin_shutdown
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now
+}
+
+// classify wraps driver errors that have a meaning to callers into the matching core error
+func classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	// the caller's own deadline or cancellation, which a net.Error check would take for the shard's
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return err
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case pqErr.Code == uniqueViolation:
+			return fmt.Errorf("%w: %v", core.ErrDuplicateCell, err)
+		case pqErr.Code.Class() == connectionException || unavailableCodes[pqErr.Code]:
+			return fmt.Errorf("%w: %v", core.ErrShardUnavailable, err)
+		}
+		return err
+	}
+	var netErr net.Error
+	if errors.Is(err, sqldriver.ErrBadConn) || errors.As(err, &netErr) {
+		return fmt.Errorf("%w: %v", core.ErrShardUnavailable, err)
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"code.jogchat.internal/go-schemaless/utils"
+)
+
+// execer runs statements on a *sql.DB, or within a *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+// indexWriter upserts index entries through one prepared statement per index table, so that the
+// cells of a batch do not prepare a statement each for every field. Close releases the statements.
+type indexWriter struct {
+	conn  execer
+	stmts map[string]*sql.Stmt
+}
+
+func newIndexWriter(conn execer) *indexWriter {
+	return &indexWriter{conn: conn, stmts: make(map[string]*sql.Stmt)}
+}
+
+// put upserts the entry of rowKey in the index table of column and field
+func (w *indexWriter) put(ctx context.Context, column string, field string, rowKey []byte, value interface{}) error {
+	table := utils.IndexTableName(column, field)
+	stmt, ok := w.stmts[table]
+	if !ok {
+		var err error
+		stmt, err = w.conn.PrepareContext(ctx, fmt.Sprintf(insertIndexSQL, table, field, field, field))
+		if err != nil {
+			return classify(err)
+		}
+		w.stmts[table] = stmt
+	}
+	_, err := stmt.ExecContext(ctx, rowKey, value)
+	return classify(err)
+}
+
+// Close closes the prepared statements
+func (w *indexWriter) Close() {
+	for _, stmt := range w.stmts {
+		stmt.Close()
+	}
+}
+
+// PutIndex updates all Index tables relevant to the current cell, If entry does not exist, insert into Index table instead
+func PutIndex(ctx context.Context, conn execer, column string, field string, rowKey []byte, value interface{}) error {
+	index := newIndexWriter(conn)
+	defer index.Close()
+	return index.put(ctx, column, field, rowKey, value)
+}
+
+// Query index table specified by column and field name, return a list of row_key
+func QueryByField(ctx context.Context, conn *sql.DB, column string, field string, value interface{}, operator string) ([][]byte, error) {
+	stmt := fmt.Sprintf(queryIndexSQL, utils.IndexTableName(column, field), field, operator)
+	rows, err := conn.QueryContext(ctx, stmt, value)
+	if err != nil {
+		return nil, classify(err)
+	}
+	defer rows.Close()
+	return extractRowKeys(rows)
+}
+
+// Check if value exist in index table, return true if value already exist
+func CheckValueExist(ctx context.Context, conn *sql.DB, column string, field string, value interface{}) (bool, error) {
+	stmt := fmt.Sprintf(queryIndexSQL, utils.IndexTableName(column, field), field, "=")
+	results, err := conn.QueryContext(ctx, stmt, value)
+	if err != nil {
+		return false, classify(err)
+	}
+	defer results.Close()
+	exist := results.Next()
+	return exist, classify(results.Err())
+}
+
+// extract a list of row_key
+func extractRowKeys(rows *sql.Rows) ([][]byte, error) {
+	var rowKeys [][]byte
+	for rows.Next() {
+		var rowKey []byte
+		if err := rows.Scan(&rowKey); err != nil {
+			return nil, classify(err)
+		}
+		rowKeys = append(rowKeys, rowKey)
+	}
+	return rowKeys, classify(rows.Err())
+}
@@ -0,0 +1,87 @@
+package postgres
+
+import (
+	"context"
+	sqldriver "database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"code.jogchat.internal/go-schemaless/core"
+	"code.jogchat.internal/go-schemaless/storagetest"
+	"code.jogchat.internal/go-schemaless/utils"
+)
+
+// same layout as schemaless_tables.md, created on the fly so a blank local database is enough
+const createCellTableSQL = "CREATE TABLE IF NOT EXISTS cell (" +
+	"added_at BIGSERIAL PRIMARY KEY, " +
+	"row_key BYTEA NOT NULL, " +
+	"column_name VARCHAR(64) NOT NULL, " +
+	"ref_key BIGINT NOT NULL, " +
+	"body BYTEA, " +
+	"created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, " +
+	"CONSTRAINT cell_idx UNIQUE (row_key, column_name, ref_key))"
+
+const createCheckpointTableSQL = "CREATE TABLE IF NOT EXISTS checkpoint (" +
+	"consumer VARCHAR(64) NOT NULL PRIMARY KEY, " +
+	"added_at BIGINT NOT NULL)"
+
+// newTestStorage connects to the Postgres described by PGUSER, PGPASS, SQLHOST and PGDATABASE
+func newTestStorage(t *testing.T) *Storage {
+	user := os.Getenv("PGUSER")
+	if user == "" {
+		t.Skip("PGUSER not set, skipping postgres tests")
+	}
+	host := os.Getenv("SQLHOST")
+	if host == "" {
+		host = "localhost"
+	}
+	database := os.Getenv("PGDATABASE")
+	if database == "" {
+		database = "schemaless"
+	}
+
+	s := New().WithUser(user).
+		WithPass(os.Getenv("PGPASS")).
+		WithHost(host).
+		WithPort("5432").
+		WithDatabase(database)
+	if err := s.WithZap(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestPostgresStorage(t *testing.T) {
+	s := newTestStorage(t)
+	_, err := s.store.Exec(createCellTableSQL)
+	utils.CheckErr(err)
+	_, err = s.store.Exec(createCheckpointTableSQL)
+	utils.CheckErr(err)
+	for field, sqlType := range storagetest.IndexedFields {
+		table := utils.IndexTableName(storagetest.Column, field)
+		_, err = s.store.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (row_key BYTEA PRIMARY KEY, %s %s NOT NULL)", table, field, sqlType))
+		utils.CheckErr(err)
+	}
+	s.store.Close()
+
+	storagetest.StorageTest(t, func() core.Storage { return newTestStorage(t) })
+}
+
+func TestClassify(t *testing.T) {
+	for _, err := range []error{context.DeadlineExceeded, context.Canceled, fmt.Errorf("query: %w", context.DeadlineExceeded)} {
+		if classified := classify(err); errors.Is(classified, core.ErrShardUnavailable) || classified != err {
+			t.Errorf("%v: got %v, the caller's context error must be kept", err, classified)
+		}
+	}
+	for _, err := range []error{sqldriver.ErrBadConn, &net.OpError{Op: "dial", Err: errors.New("connection refused")}} {
+		if classified := classify(err); !errors.Is(classified, core.ErrShardUnavailable) {
+			t.Errorf("%v: got %v, want ErrShardUnavailable", err, classified)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package sqlite
+
+import (
+	"errors"
+	"fmt"
+
+	"code.jogchat.internal/go-schemaless/core"
+	"github.com/mattn/go-sqlite3"
+)
+
+// classify wraps driver errors that have a meaning to callers into the matching core error
+func classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return err
+	}
+	switch {
+	case sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique, sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey:
+		return fmt.Errorf("%w: %v", core.ErrDuplicateCell, err)
+	case sqliteErr.Code == sqlite3.ErrCantOpen, sqliteErr.Code == sqlite3.ErrBusy, sqliteErr.Code == sqlite3.ErrLocked:
+		// the file is gone or another process holds the write lock past the busy timeout
+		return fmt.Errorf("%w: %v", core.ErrShardUnavailable, err)
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.jogchat.internal/go-schemaless/core"
+	"code.jogchat.internal/go-schemaless/models"
+	"code.jogchat.internal/go-schemaless/storagetest"
+	"code.jogchat.internal/go-schemaless/utils"
+)
+
+func TestSqliteStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schemaless-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	shards := 0
+	storagetest.StorageTest(t, func() core.Storage {
+		shards++
+		s := New().WithPath(filepath.Join(dir, fmt.Sprintf("shard%d.db", shards)))
+		if err := s.WithZap(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Open(); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestRetryHealsIndex(t *testing.T) {
+	ctx := context.TODO()
+	dir, err := ioutil.TempDir("", "schemaless-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := New().WithPath(filepath.Join(dir, "shard.db"))
+	if err := s.WithZap(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Destroy(ctx)
+
+	rowKey := utils.NewUUID().Bytes()
+	cell := models.NewCell(rowKey, storagetest.Column, 1, []byte(`{"name":"ann"}`))
+	if err := s.PutCell(ctx, rowKey, cell.ColumnName, cell.RefKey, cell); err != nil {
+		t.Fatal(err)
+	}
+	// as if the write had failed before reaching the index table
+	if _, err := s.store.ExecContext(ctx, "DELETE FROM "+utils.IndexTableName(storagetest.Column, "name")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.PutCell(ctx, rowKey, cell.ColumnName, cell.RefKey, cell); err != nil {
+		t.Fatal(err)
+	}
+	found, err := s.CheckValueExist(ctx, storagetest.Column, "name", "ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Error("the retried write did not heal the index")
+	}
+}
+
+func TestPutCellsIndexFailure(t *testing.T) {
+	ctx := context.TODO()
+	dir, err := ioutil.TempDir("", "schemaless-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := New().WithPath(filepath.Join(dir, "shard.db"))
+	if err := s.WithZap(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Destroy(ctx)
+
+	ann := models.NewCell(utils.NewUUID().Bytes(), storagetest.Column, 1, []byte(`{"name":"ann"}`))
+	// a nested value cannot be written to an index table
+	bob := models.NewCell(utils.NewUUID().Bytes(), storagetest.Column, 1, []byte(`{"name":{"first":"bob"}}`))
+	if err := s.PutCells(ctx, []models.Cell{ann, bob}); err == nil {
+		t.Fatal("the batch was written along with an unindexable cell")
+	}
+	if _, found, err := s.GetCellLatest(ctx, ann.RowKey, storagetest.Column); err != nil || found {
+		t.Fatalf("a failed batch left a cell behind: found %v, err %v", found, err)
+	}
+
+	// retried without the bad cell, the batch goes through whole
+	if err := s.PutCells(ctx, []models.Cell{ann}); err != nil {
+		t.Fatal(err)
+	}
+	found, err := s.CheckValueExist(ctx, storagetest.Column, "name", "ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Error("the retried batch was not indexed")
+	}
+}
@@ -0,0 +1,659 @@
+// Package storagetest is a conformance suite for core.Storage implementations.
+//
+// Backends call StorageTest from their own tests with a constructor returning
+// a ready-to-use Storage. Every run writes fresh row keys and field values,
+// so the suite can be pointed at a long-lived database; only the cells it
+// wrote itself are asserted on.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"code.jogchat.internal/go-schemaless/core"
+	"code.jogchat.internal/go-schemaless/models"
+	"code.jogchat.internal/go-schemaless/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	// Column is the column every indexed cell of the suite is written to
+	Column = "storagetest"
+	// UnindexedColumn holds cells written with all of their fields ignored, so it needs no index tables
+	UnindexedColumn = "storagetest_unindexed"
+)
+
+// IndexedFields maps the body fields the suite indexes under Column to a SQL
+// type wide enough for them, for backends whose index tables must be created
+// up front, see utils.IndexTableName.
+var IndexedFields = map[string]string{
+	"name": "VARCHAR(255)",
+	"age":  "INTEGER",
+}
+
+// StorageTest runs the conformance suite, calling newStorage once per sub-test
+func StorageTest(t *testing.T, newStorage func() core.Storage) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s core.Storage)
+	}{
+		{"PutGetLatest", testPutGetLatest},
+		{"VersionOrdering", testVersionOrdering},
+		{"GetCell", testGetCell},
+		{"GetCellVersions", testGetCellVersions},
+		{"GetRowLatest", testGetRowLatest},
+		{"PutCells", testPutCells},
+		{"MultiGetCellLatest", testMultiGetCellLatest},
+		{"ScanCells", testScanCells},
+		{"Immutability", testImmutability},
+		{"PutCellIf", testPutCellIf},
+		{"Checkpoints", testCheckpoints},
+		{"GetCellsByColumnLatest", testGetCellsByColumnLatest},
+		{"IndexOperators", testIndexOperators},
+		{"IndexFollowsLatest", testIndexFollowsLatest},
+		{"Uniqueness", testUniqueness},
+		{"Destroy", testDestroy},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStorage()
+			defer s.Destroy(context.TODO())
+			tt.test(t, s)
+		})
+	}
+}
+
+type person struct {
+	rowKey []byte
+	name   string
+	age    int
+}
+
+func newPerson(run string, name string, age int) person {
+	return person{rowKey: utils.NewUUID().Bytes(), name: run + "-" + name, age: age}
+}
+
+func (p person) body() []byte {
+	return []byte(fmt.Sprintf(`{"name":%q,"age":%d}`, p.name, p.age))
+}
+
+// newRun returns a prefix unique to this run, keeping field values apart from earlier runs
+func newRun() string {
+	return utils.NewUUID().String()[:8]
+}
+
+func putCell(ctx context.Context, s core.Storage, rowKey []byte, columnKey string, refKey int64, body []byte, ignoreFields ...string) error {
+	return s.PutCell(ctx, rowKey, columnKey, refKey, models.NewCell(rowKey, columnKey, refKey, body), ignoreFields...)
+}
+
+func mustPut(t *testing.T, s core.Storage, rowKey []byte, columnKey string, refKey int64, body []byte, ignoreFields ...string) {
+	if err := putCell(context.TODO(), s, rowKey, columnKey, refKey, body, ignoreFields...); err != nil {
+		t.Fatalf("PutCell(%x, %s, %d): %v", rowKey, columnKey, refKey, err)
+	}
+}
+
+// rowKeysOf returns the sorted row keys of cells that belong to the given people
+func rowKeysOf(cells []models.Cell, people ...person) []string {
+	ours := make(map[string]bool)
+	for _, p := range people {
+		ours[string(p.rowKey)] = true
+	}
+	var keys []string
+	for _, cell := range cells {
+		if ours[string(cell.RowKey)] {
+			keys = append(keys, string(cell.RowKey))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// keysOf returns the sorted row keys of people, comparable with rowKeysOf
+func keysOf(people ...person) []string {
+	var keys []string
+	for _, p := range people {
+		keys = append(keys, string(p.rowKey))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func testPutGetLatest(t *testing.T, s core.Storage) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+	p := newPerson(newRun(), "ann", 20)
+
+	_, found, err := s.GetCellLatest(ctx, p.rowKey, Column)
+	assert.NoError(err)
+	assert.False(found)
+
+	mustPut(t, s, p.rowKey, Column, 1, p.body())
+
+	cell, found, err := s.GetCellLatest(ctx, p.rowKey, Column)
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(p.rowKey, cell.RowKey)
+	assert.Equal(Column, cell.ColumnName)
+	assert.Equal(int64(1), cell.RefKey)
+	assert.Equal(p.body(), cell.Body)
+	assert.NotZero(cell.AddedAt)
+	assert.NotNil(cell.CreatedAt)
+
+	// columns of the same row are versioned independently
+	mustPut(t, s, p.rowKey, UnindexedColumn, 10, []byte(`{"note":"x"}`), "note")
+	cell, found, err = s.GetCellLatest(ctx, p.rowKey, Column)
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(int64(1), cell.RefKey)
+}
+
+func testVersionOrdering(t *testing.T, s core.Storage) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+	p := newPerson(newRun(), "ann", 20)
+
+	// latest is decided by ref key, not by write order
+	for _, refKey := range []int64{5, 3, 7, 4} {
+		p.age = int(refKey)
+		mustPut(t, s, p.rowKey, Column, refKey, p.body())
+	}
+
+	cell, found, err := s.GetCellLatest(ctx, p.rowKey, Column)
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(int64(7), cell.RefKey)
+	p.age = 7
+	assert.Equal(p.body(), cell.Body)
+}
+
+func testGetCell(t *testing.T, s core.Storage) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+	p := newPerson(newRun(), "ann", 20)
+
+	bodies := make(map[int64][]byte)
+	for _, refKey := range []int64{1, 2, 3} {
+		p.age = 20 + int(refKey)
+		bodies[refKey] = p.body()
+		mustPut(t, s, p.rowKey, Column, refKey, bodies[refKey])
+	}
+
+	for refKey, body := range bodies {
+		cell, found, err := s.GetCell(ctx, p.rowKey, Column, refKey)
+		assert.NoError(err)
+		assert.True(found)
+		assert.Equal(refKey, cell.RefKey)
+		assert.Equal(body, cell.Body)
+		assert.NotNil(cell.CreatedAt)
+	}
+
+	_, found, err := s.GetCell(ctx, p.rowKey, Column, 4)
+	assert.NoError(err)
+	assert.False(found)
+
+	_, found, err = s.GetCell(ctx, p.rowKey, UnindexedColumn, 1)
+	assert.NoError(err)
+	assert.False(found)
+}
+
+func testGetCellVersions(t *testing.T, s core.Storage) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+	p := newPerson(newRun(), "ann", 20)
+
+	for _, refKey := range []int64{30, 10, 50, 20, 40} {
+		mustPut(t, s, p.rowKey, Column, refKey, p.body())
+	}
+	mustPut(t, s, p.rowKey, UnindexedColumn, 60, []byte(`{"note":"x"}`), "note")
+
+	refKeys := func(cells []models.Cell) []int64 {
+		var keys []int64
+		for _, cell := range cells {
+			keys = append(keys, cell.RefKey)
+		}
+		return keys
+	}
+	ref := func(refKey int64) *int64 { return &refKey }
+
+	tests := []struct {
+		opts core.VersionOptions
+		want []int64
+	}{
+		{core.VersionOptions{}, []int64{10, 20, 30, 40, 50}},
+		{core.VersionOptions{Descending: true}, []int64{50, 40, 30, 20, 10}},
+		{core.VersionOptions{Limit: 2}, []int64{10, 20}},
+		{core.VersionOptions{Limit: 2, Descending: true}, []int64{50, 40}},
+		{core.VersionOptions{MinRefKey: ref(20), MaxRefKey: ref(40)}, []int64{20, 30, 40}},
+		{core.VersionOptions{MinRefKey: ref(25), Descending: true, Limit: 2}, []int64{50, 40}},
+		{core.VersionOptions{MaxRefKey: ref(25), Descending: true}, []int64{20, 10}},
+	}
+	for _, tt := range tests {
+		cells, found, err := s.GetCellVersions(ctx, p.rowKey, Column, tt.opts)
+		assert.NoError(err)
+		assert.True(found)
+		assert.Equal(tt.want, refKeys(cells), "%+v", tt.opts)
+		for _, cell := range cells {
+			assert.Equal(Column, cell.ColumnName)
+		}
+	}
+
+	cells, found, err := s.GetCellVersions(ctx, p.rowKey, Column, core.VersionOptions{MinRefKey: ref(51)})
+	assert.NoError(err)
+	assert.False(found)
+	assert.Empty(cells)
+}
+
+func testGetRowLatest(t *testing.T, s core.Storage) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+	p := newPerson(newRun(), "ann", 20)
+
+	mustPut(t, s, p.rowKey, Column, 1, p.body())
+	p.age = 21
+	mustPut(t, s, p.rowKey, Column, 2, p.body())
+	mustPut(t, s, p.rowKey, UnindexedColumn, 1, []byte(`{"note":"x"}`), "note")
+	other := newPerson(newRun(), "bob", 30)
+	mustPut(t, s, other.rowKey, Column, 3, other.body())
+
+	cells, found, err := s.GetRowLatest(ctx, p.rowKey)
+	assert.NoError(err)
+	assert.True(found)
+	if assert.Len(cells, 2) {
+		assert.Equal(int64(2), cells[Column].RefKey)
+		assert.Equal(p.body(), cells[Column].Body)
+		assert.Equal(int64(1), cells[UnindexedColumn].RefKey)
+		assert.Equal(UnindexedColumn, cells[UnindexedColumn].ColumnName)
+	}
+
+	cells, found, err = s.GetRowLatest(ctx, p.rowKey, UnindexedColumn, "storagetest_missing")
+	assert.NoError(err)
+	assert.True(found)
+	if assert.Len(cells, 1) {
+		assert.Equal([]byte(`{"note":"x"}`), cells[UnindexedColumn].Body)
+	}
+
+	cells, found, err = s.GetRowLatest(ctx, newPerson(newRun(), "cat", 40).rowKey)
+	assert.NoError(err)
+	assert.False(found)
+	assert.Empty(cells)
+}
+
+func testPutCells(t *testing.T, s core.Storage) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+	run := newRun()
+	ann, bob := newPerson(run, "ann", 20), newPerson(run, "bob", 30)
+
+	assert.NoError(s.PutCells(ctx, nil))
+
+	cells := []models.Cell{
+		models.NewCell(ann.rowKey, Column, 1, ann.body()),
+		models.NewCell(bob.rowKey, Column, 1, bob.body()),
+	}
+	ann.age = 21
+	cells = append(cells, models.NewCell(ann.rowKey, Column, 2, ann.body()))
+	assert.NoError(s.PutCells(ctx, cells))
+
+	cell, found, err := s.GetCellLatest(ctx, ann.rowKey, Column)
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(int64(2), cell.RefKey)
+	assert.Equal(ann.body(), cell.Body)
+
+	found, err = s.CheckValueExist(ctx, Column, "name", bob.name)
+	assert.NoError(err)
+	assert.True(found, "batched cells are indexed")
+
+	// a batch holding an existing cell is rejected as a whole
+	cat := newPerson(run, "cat", 40)
+	err = s.PutCells(ctx, []models.Cell{
+		models.NewCell(cat.rowKey, Column, 1, cat.body()),
+		models.NewCell(bob.rowKey, Column, 1, bob.body()),
+	})
+	assert.True(errors.Is(err, core.ErrDuplicateCell), "got %v", err)
+	_, found, err = s.GetCellLatest(ctx, cat.rowKey, Column)
+	assert.NoError(err)
+	assert.False(found)
+
+	// many cells may exceed a single statement's placeholder limit
+	var batch []models.Cell
+	for refKey := int64(1); refKey <= 2500; refKey++ {
+		batch = append(batch, models.NewCell(cat.rowKey, UnindexedColumn, refKey, []byte(`{"note":"x"}`)))
+	}
+	assert.NoError(s.PutCells(ctx, batch, "note"))
+	cell, found, err = s.GetCellLatest(ctx, cat.rowKey, UnindexedColumn)
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(int64(2500), cell.RefKey)
+}
+
+func testMultiGetCellLatest(t *testing.T, s core.Storage) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+	run := newRun()
+
+	var rowKeys [][]byte
+	var batch []models.Cell
+	for i := 0; i < 1200; i++ {
+		p := newPerson(run, fmt.Sprintf("p%d", i), i)
+		rowKeys = append(rowKeys, p.rowKey)
+		batch = append(batch, models.NewCell(p.rowKey, UnindexedColumn, 1, []byte(`{"version":1}`)))
+		if i%2 == 0 {
+			batch = append(batch, models.NewCell(p.rowKey, UnindexedColumn, 2, []byte(`{"version":2}`)))
+		}
+	}
+	if err := s.PutCells(ctx, batch, "version"); err != nil {
+		t.Fatal(err)
+	}
+	missing := newPerson(run, "missing", 0).rowKey
+
+	cells, found, err := s.MultiGetCellLatest(ctx, append(rowKeys, missing), UnindexedColumn)
+	assert.NoError(err)
+	assert.True(found)
+	assert.Len(cells, len(rowKeys))
+	for i, rowKey := range rowKeys {
+		cell, ok := cells[string(rowKey)]
+		if !assert.True(ok) {
+			continue
+		}
+		if i%2 == 0 {
+			assert.Equal(int64(2), cell.RefKey)
+		} else {
+			assert.Equal(int64(1), cell.RefKey)
+		}
+	}
+	_, ok := cells[string(missing)]
+	assert.False(ok)
+
+	cells, found, err = s.MultiGetCellLatest(ctx, [][]byte{missing}, UnindexedColumn)
+	assert.NoError(err)
+	assert.False(found)
+	assert.Empty(cells)
+}
+
+func testScanCells(t *testing.T, s core.Storage) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+	run := newRun()
+
+	// added_at is assigned by the backend, so scan from the first cell this run wrote
+	first := newPerson(run, "p0", 0)
+	mustPut(t, s, first.rowKey, UnindexedColumn, 1, first.body(), "name", "age")
+	cell, found, err := s.GetCellLatest(ctx, first.rowKey, UnindexedColumn)
+	if !assert.NoError(err) || !assert.True(found) {
+		return
+	}
+	after := cell.AddedAt - 1
+
+	written := [][]byte{first.rowKey}
+	for i := 1; i < 5; i++ {
+		p := newPerson(run, fmt.Sprintf("p%d", i), i)
+		mustPut(t, s, p.rowKey, UnindexedColumn, 1, p.body(), "name", "age")
+		written = append(written, p.rowKey)
+	}
+
+	count, err := s.CountCellsAfter(ctx, after)
+	assert.NoError(err)
+	assert.Equal(int64(len(written)), count)
+
+	var scanned [][]byte
+	for {
+		cells, found, err := s.ScanCells(ctx, after, 2)
+		if !assert.NoError(err) {
+			return
+		}
+		if !found {
+			break
+		}
+		assert.True(len(cells) <= 2)
+		for _, cell := range cells {
+			assert.True(cell.AddedAt > after, "added_at grows along the scan")
+			after = cell.AddedAt
+			scanned = append(scanned, cell.RowKey)
+		}
+	}
+	assert.Equal(written, scanned)
+
+	count, err = s.CountCellsAfter(ctx, after)
+	assert.NoError(err)
+	assert.Zero(count)
+}
+
+func testImmutability(t *testing.T, s core.Storage) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+	p := newPerson(newRun(), "ann", 20)
+
+	mustPut(t, s, p.rowKey, Column, 1, p.body())
+
+	changed := p
+	changed.age = 21
+	err := putCell(ctx, s, p.rowKey, Column, 1, changed.body())
+	assert.True(errors.Is(err, core.ErrConflictingCell), "(row, column, ref) must be written once, got %v", err)
+
+	// retrying the same write succeeds and leaves the indexes in place
+	assert.NoError(putCell(ctx, s, p.rowKey, Column, 1, p.body()))
+	found, err := s.CheckValueExist(ctx, Column, "name", p.name)
+	assert.NoError(err)
+	assert.True(found)
+
+	cell, found, err := s.GetCellLatest(ctx, p.rowKey, Column)
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(p.body(), cell.Body)
+
+	// the same ref key is free in another column
+	assert.NoError(putCell(ctx, s, p.rowKey, UnindexedColumn, 1, []byte(`{"note":"x"}`), "note"))
+}
+
+func testPutCellIf(t *testing.T, s core.Storage) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+	p := newPerson(newRun(), "ann", 20)
+
+	err := s.PutCellIf(ctx, models.NewCell(p.rowKey, Column, 1, p.body()), 0)
+	assert.True(errors.Is(err, core.ErrPreconditionFailed), "no cell to match, got %v", err)
+	assert.NoError(s.PutCellIf(ctx, models.NewCell(p.rowKey, Column, 1, p.body()), core.NoRefKey))
+	err = s.PutCellIf(ctx, models.NewCell(p.rowKey, Column, 2, p.body()), core.NoRefKey)
+	assert.True(errors.Is(err, core.ErrPreconditionFailed), "the cell exists, got %v", err)
+
+	old := p.name
+	p.name += "-renamed"
+	assert.NoError(s.PutCellIf(ctx, models.NewCell(p.rowKey, Column, 2, p.body()), 1))
+	err = s.PutCellIf(ctx, models.NewCell(p.rowKey, Column, 3, p.body()), 1)
+	assert.True(errors.Is(err, core.ErrPreconditionFailed), "ref key 1 is no longer the latest, got %v", err)
+
+	cell, found, err := s.GetCellLatest(ctx, p.rowKey, Column)
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(int64(2), cell.RefKey)
+
+	// conditional writes are indexed like any other
+	exist, err := s.CheckValueExist(ctx, Column, "name", p.name)
+	assert.NoError(err)
+	assert.True(exist)
+	exist, err = s.CheckValueExist(ctx, Column, "name", old)
+	assert.NoError(err)
+	assert.False(exist)
+}
+
+func testCheckpoints(t *testing.T, s core.Storage) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+	consumer := "storagetest-" + newRun()
+
+	addedAt, err := s.LoadCheckpoint(ctx, consumer)
+	assert.NoError(err)
+	assert.Zero(addedAt)
+	assert.NoError(s.SaveCheckpoint(ctx, consumer, 42))
+	assert.NoError(s.SaveCheckpoint(ctx, consumer, 7))
+	addedAt, err = s.LoadCheckpoint(ctx, consumer)
+	assert.NoError(err)
+	assert.Equal(int64(7), addedAt, "the last save wins, even backwards")
+
+	p := newPerson(newRun(), "ann", 20)
+	before := time.Now()
+	mustPut(t, s, p.rowKey, Column, 1, p.body())
+	after := time.Now()
+	cell, _, err := s.GetCellLatest(ctx, p.rowKey, Column)
+	assert.NoError(err)
+
+	last, err := s.LastAddedAt(ctx, time.Time{})
+	assert.NoError(err)
+	assert.True(last >= cell.AddedAt)
+	// created_at may be truncated to the second
+	last, err = s.LastAddedAt(ctx, after.Add(2*time.Second))
+	assert.NoError(err)
+	assert.True(last >= cell.AddedAt)
+	last, err = s.LastAddedAt(ctx, before.Add(-2*time.Second))
+	assert.NoError(err)
+	assert.True(last < cell.AddedAt)
+}
+
+func testGetCellsByColumnLatest(t *testing.T, s core.Storage) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+	run := newRun()
+	ann, bob := newPerson(run, "ann", 20), newPerson(run, "bob", 30)
+
+	mustPut(t, s, ann.rowKey, Column, 1, ann.body())
+	ann.age = 21
+	mustPut(t, s, ann.rowKey, Column, 2, ann.body())
+	mustPut(t, s, bob.rowKey, Column, 1, bob.body())
+	// a higher ref key in another column must not hide bob's latest cell
+	mustPut(t, s, bob.rowKey, UnindexedColumn, 100, []byte(`{"note":"x"}`), "note")
+
+	cells, found, err := s.GetCellsByColumnLatest(ctx, Column)
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(keysOf(ann, bob), rowKeysOf(cells, ann, bob))
+	for _, cell := range cells {
+		assert.Equal(Column, cell.ColumnName)
+		if string(cell.RowKey) == string(ann.rowKey) {
+			assert.Equal(int64(2), cell.RefKey)
+			assert.Equal(ann.body(), cell.Body)
+		}
+	}
+
+	_, found, err = s.GetCellsByColumnLatest(ctx, "storagetest_"+run)
+	assert.NoError(err)
+	assert.False(found)
+}
+
+func testIndexOperators(t *testing.T, s core.Storage) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+	run := newRun()
+	ann, bob, cat := newPerson(run, "ann", 20), newPerson(run, "bob", 30), newPerson(run, "cat", 40)
+	for _, p := range []person{ann, bob, cat} {
+		mustPut(t, s, p.rowKey, Column, 1, p.body())
+	}
+	all := []person{ann, bob, cat}
+
+	tests := []struct {
+		field    string
+		operator string
+		value    interface{}
+		want     []person
+	}{
+		{"age", "=", 30, []person{bob}},
+		{"age", "!=", 30, []person{ann, cat}},
+		{"age", "<>", 30, []person{ann, cat}},
+		{"age", "<", 30, []person{ann}},
+		{"age", "<=", 30, []person{ann, bob}},
+		{"age", ">", 30, []person{cat}},
+		{"age", ">=", 30, []person{bob, cat}},
+		{"name", "=", bob.name, []person{bob}},
+		{"name", "LIKE", run + "-%", all},
+		{"name", "LIKE", run + "-b%", []person{bob}},
+		{"name", "LIKE", run + "-c_t", []person{cat}},
+	}
+	for _, tt := range tests {
+		cells, _, err := s.GetCellsByFieldLatest(ctx, Column, tt.field, tt.value, tt.operator)
+		assert.NoError(err, "%s %s %v", tt.field, tt.operator, tt.value)
+		assert.Equal(keysOf(tt.want...), rowKeysOf(cells, all...), "%s %s %v", tt.field, tt.operator, tt.value)
+		for _, cell := range cells {
+			assert.Equal(Column, cell.ColumnName)
+		}
+	}
+
+	exist, err := s.CheckValueExist(ctx, Column, "name", cat.name)
+	assert.NoError(err)
+	assert.True(exist)
+
+	exist, err = s.CheckValueExist(ctx, Column, "name", run+"-dan")
+	assert.NoError(err)
+	assert.False(exist)
+}
+
+func testIndexFollowsLatest(t *testing.T, s core.Storage) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+	p := newPerson(newRun(), "ann", 20)
+
+	mustPut(t, s, p.rowKey, Column, 1, p.body())
+	old := p.name
+	p.name += "-renamed"
+	mustPut(t, s, p.rowKey, Column, 2, p.body())
+
+	exist, err := s.CheckValueExist(ctx, Column, "name", old)
+	assert.NoError(err)
+	assert.False(exist, "index tables hold the value of the latest write")
+
+	cells, _, err := s.GetCellsByFieldLatest(ctx, Column, "name", p.name, "=")
+	assert.NoError(err)
+	if assert.Len(rowKeysOf(cells, p), 1) {
+		assert.Equal(int64(2), cells[0].RefKey)
+		assert.Equal(p.body(), cells[0].Body)
+	}
+
+	// fields listed as ignored are not indexed
+	ignored := newPerson(newRun(), "bob", 30)
+	mustPut(t, s, ignored.rowKey, Column, 1, ignored.body(), "name")
+	exist, err = s.CheckValueExist(ctx, Column, "name", ignored.name)
+	assert.NoError(err)
+	assert.False(exist)
+}
+
+func testUniqueness(t *testing.T, s core.Storage) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+	run := newRun()
+	ann, twin := newPerson(run, "ann", 20), newPerson(run, "ann", 21)
+	bob := newPerson(run, "bob", 30)
+	for _, p := range []person{ann, twin, bob} {
+		mustPut(t, s, p.rowKey, Column, 1, p.body())
+	}
+
+	cell, found, err := s.GetCellByUniqueFieldLatest(ctx, Column, "name", bob.name)
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(bob.rowKey, cell.RowKey)
+
+	_, found, err = s.GetCellByUniqueFieldLatest(ctx, Column, "name", ann.name)
+	assert.True(errors.Is(err, core.ErrNotUnique), "two rows share the value, got %v", err)
+	assert.False(found)
+
+	_, found, err = s.GetCellByUniqueFieldLatest(ctx, Column, "name", run+"-dan")
+	assert.NoError(err)
+	assert.False(found)
+}
+
+func testDestroy(t *testing.T, s core.Storage) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+	p := newPerson(newRun(), "ann", 20)
+
+	mustPut(t, s, p.rowKey, Column, 1, p.body())
+	assert.NoError(s.Destroy(ctx))
+
+	// a destroyed storage must not keep serving its cells, failing is fine
+	_, found, err := s.GetCellLatest(ctx, p.rowKey, Column)
+	assert.False(found && err == nil)
+}